@@ -1,14 +1,60 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/aes"
+	"go.mozilla.org/sops/v3/cmd/sops/common"
 	"go.mozilla.org/sops/v3/cmd/sops/formats"
-	"go.mozilla.org/sops/v3/decrypt"
+	"go.mozilla.org/sops/v3/keyservice"
+	"go.mozilla.org/sops/v3/shamir"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	goyaml "gopkg.in/yaml.v2"
+	"sigs.k8s.io/kustomize/api/filesys"
 	"sigs.k8s.io/kustomize/api/ifc"
 	"sigs.k8s.io/kustomize/api/kv"
 	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
 	"sigs.k8s.io/kustomize/api/types"
 	"sigs.k8s.io/yaml"
-	"strings"
 )
 
 type plugin struct {
@@ -16,76 +62,2719 @@ type plugin struct {
 	types.ObjectMeta `json:"metadata,omitempty" yaml:"metadata,omitempty" protobuf:"bytes,1,opt,name=metadata"`
 	types.GeneratorOptions
 	types.SecretArgs
+
+	// IgnoreMac decrypts sources whose MAC does not match their content,
+	// logging a warning instead of failing the build.
+	IgnoreMac bool `json:"ignoreMac,omitempty" yaml:"ignoreMac,omitempty"`
+
+	// AuditLog is the file every decryption is recorded to, as JSON lines.
+	// Defaults to the value of the AuditLogEnv environment variable.
+	AuditLog string `json:"auditLog,omitempty" yaml:"auditLog,omitempty"`
+
+	// Sources attaches rotation policies to the envs and files sources.
+	Sources []SourceOptions `json:"sources,omitempty" yaml:"sources,omitempty"`
+
+	// Directories are walked recursively, each file becoming a key.
+	Directories []DirectorySource `json:"directories,omitempty" yaml:"directories,omitempty"`
+
+	// Merge decides what happens to keys defined by several sources.
+	Merge MergeOptions `json:"merge,omitempty" yaml:"merge,omitempty"`
+
+	// Vars are the default values of the ${VAR} references expanded in the
+	// name, namespace, labels, annotations and source paths. The process
+	// environment takes precedence over them.
+	Vars map[string]string `json:"vars,omitempty" yaml:"vars,omitempty"`
+
+	// Registries are the sources of the registry credentials a
+	// sealed/dockerconfigjson Secret is built from. Each is a YAML or JSON
+	// file holding a list of RegistryCredentials under "registries".
+	Registries []string `json:"registries,omitempty" yaml:"registries,omitempty"`
+
+	// Size guards the size of the generated Secret.
+	Size SizeOptions `json:"size,omitempty" yaml:"size,omitempty"`
+
+	// Compression compresses large values, such as GeoIP databases, to keep
+	// the Secret under the size limit.
+	Compression CompressionOptions `json:"compression,omitempty" yaml:"compression,omitempty"`
+
+	// Keys configures the validation of the Secret keys.
+	Keys KeyOptions `json:"keys,omitempty" yaml:"keys,omitempty"`
+
+	// Flatten configures how the nested values of YAML and JSON envs sources
+	// become keys. They fail the build by default.
+	Flatten FlattenOptions `json:"flatten,omitempty" yaml:"flatten,omitempty"`
+
+	// Keystores are Java keystores built from PEM encoded sources.
+	Keystores []KeystoreSource `json:"keystores,omitempty" yaml:"keystores,omitempty"`
+
+	// TLS configures the validation of sealed/tls Secrets.
+	TLS TLSOptions `json:"tls,omitempty" yaml:"tls,omitempty"`
+
+	// SSH configures the validation of sealed/ssh-auth Secrets.
+	SSH SSHOptions `json:"ssh,omitempty" yaml:"ssh,omitempty"`
+
+	// Immutable marks the generated Secret immutable. Its name always gets a
+	// hash suffix then, so that changes roll out as a new Secret.
+	Immutable bool `json:"immutable,omitempty" yaml:"immutable,omitempty"`
+
+	// Output is either "data", the default, or "stringData", which emits the
+	// UTF-8 values as plain text for readable diffs when debugging locally.
+	// Binary values stay in data. Kustomize only hashes data into the name
+	// suffix, so stringData must not be used to deploy.
+	Output string `json:"output,omitempty" yaml:"output,omitempty"`
+
+	// Strict forbids the options meant for local debugging, such as
+	// output: stringData.
+	Strict bool `json:"strict,omitempty" yaml:"strict,omitempty"`
+
+	// Provenance annotates the generated Secret with the sources it was
+	// decrypted from, their SOPS lastmodified, the master keys used and the
+	// plugin version. Values are never included.
+	Provenance bool `json:"provenance,omitempty" yaml:"provenance,omitempty"`
+
+	// ProvenancePrefix is prepended verbatim to the provenance and
+	// compression annotation names, DefaultProvenancePrefix by default.
+	ProvenancePrefix string `json:"provenancePrefix,omitempty" yaml:"provenancePrefix,omitempty"`
+
+	decrypted []decryption
+}
+
+// DirectorySource turns every file below Path into a key of the Secret,
+// named after its path relative to Path.
+type DirectorySource struct {
+	Path string `json:"path" yaml:"path"`
+
+	// Include and Exclude filter files with glob patterns. A pattern
+	// containing "/" matches the relative path, any other the base name.
+	Include []string `json:"include,omitempty" yaml:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+
+	// Separator replaces "/" in the key names of nested files, "_" by default.
+	Separator string `json:"separator,omitempty" yaml:"separator,omitempty"`
+}
+
+// MergeOptions holds the behavior applied when a source defines a key
+// already defined by a source of lower precedence: either "create", the
+// default, which fails, or "replace", which overrides the previous value.
+type MergeOptions struct {
+	// Behavior applies to every key without a behavior of its own.
+	Behavior string `json:"behavior,omitempty" yaml:"behavior,omitempty"`
+
+	// Keys holds per key behaviors.
+	Keys map[string]string `json:"keys,omitempty" yaml:"keys,omitempty"`
+}
+
+func (m MergeOptions) behaviorFor(key string) (string, error) {
+	behavior, ok := m.Keys[key]
+	if !ok {
+		behavior = m.Behavior
+	}
+	switch strings.ToLower(behavior) {
+	case "", "create":
+		return "create", nil
+	case "replace":
+		return "replace", nil
+	default:
+		return "", fmt.Errorf("key %q: unknown merge behavior %q", key, behavior)
+	}
+}
+
+// RegistryCredentials are the credentials of a single image registry.
+type RegistryCredentials struct {
+	Registry string `json:"registry"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+}
+
+// SizeOptions holds the limit of the size of a Secret, which Kubernetes
+// measures as the total of its decoded values, leaving out the keys and
+// the metadata.
+type SizeOptions struct {
+	// Limit is the largest total size, in bytes, of the decoded values of
+	// a Secret, MaxSecretSize by default.
+	Limit int `json:"limit,omitempty" yaml:"limit,omitempty"`
+
+	// Split spreads the keys of a Secret over the limit across several
+	// Secrets, named after it with a -0, -1... suffix, instead of failing.
+	// The first one also holds the SplitManifestKey key, listing the parts.
+	// It needs disableNameSuffixHash, as the parts are listed by name.
+	Split bool `json:"split,omitempty" yaml:"split,omitempty"`
+}
+
+// CompressionOptions holds the compression of the Secret values, after
+// decryption. The compressed keys are recorded with their codec in the
+// compression annotation, as a JSON object, so that consumers know which
+// ones to decompress.
+type CompressionOptions struct {
+	// Codec is "gzip" or "zstd". Values are left uncompressed by default.
+	Codec string `json:"codec,omitempty" yaml:"codec,omitempty"`
+
+	// Keys are glob patterns selecting the keys to compress, all of them
+	// by default.
+	Keys []string `json:"keys,omitempty" yaml:"keys,omitempty"`
+
+	// MinSize is the size, in bytes, from which values are compressed.
+	// Values that compression does not shrink are always left as is.
+	MinSize int `json:"minSize,omitempty" yaml:"minSize,omitempty"`
+}
+
+func (c CompressionOptions) matches(key string) bool {
+	if len(c.Keys) == 0 {
+		return true
+	}
+	for _, pattern := range c.Keys {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitPart is a Secret listed by the SplitManifestKey key.
+type SplitPart struct {
+	Name string   `json:"name"`
+	Keys []string `json:"keys"`
+}
+
+// KeyOptions holds the validation of the Secret keys, which may only hold
+// alphanumeric characters, "-", "_" and ".".
+type KeyOptions struct {
+	// Sanitize replaces the invalid characters of keys instead of failing:
+	// first the strings of the Mapping, longest first, then any remaining
+	// invalid character with "_".
+	Sanitize bool `json:"sanitize,omitempty" yaml:"sanitize,omitempty"`
+
+	// Mapping holds the replacements of strings in sanitized keys.
+	Mapping map[string]string `json:"mapping,omitempty" yaml:"mapping,omitempty"`
+}
+
+var (
+	validKey        = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+	invalidKeyChars = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+)
+
+// check validates the key of each pair, sanitizing it first if enabled.
+func (o KeyOptions) check(pairs []pair) ([]pair, error) {
+	var replacements []string
+	for from := range o.Mapping {
+		replacements = append(replacements, from)
+	}
+	sort.Slice(replacements, func(i, j int) bool {
+		if len(replacements[i]) != len(replacements[j]) {
+			return len(replacements[i]) > len(replacements[j])
+		}
+		return replacements[i] < replacements[j]
+	})
+	var oldnew []string
+	for _, from := range replacements {
+		oldnew = append(oldnew, from, o.Mapping[from])
+	}
+	replacer := strings.NewReplacer(oldnew...)
+
+	checked := make([]pair, len(pairs))
+	for i, p := range pairs {
+		key := p.Key
+		if o.Sanitize && !validKey.MatchString(key) {
+			key = invalidKeyChars.ReplaceAllString(replacer.Replace(key), "_")
+		}
+		if !validKey.MatchString(key) || key == "." || key == ".." {
+			if key != p.Key {
+				return nil, fmt.Errorf("key %q from %q is sanitized to %q, which is not a valid Secret key",
+					p.Key, p.source, key)
+			}
+			return nil, fmt.Errorf("key %q from %q is not a valid Secret key, "+
+				"it must consist of alphanumeric characters, \"-\", \"_\" or \".\"; "+
+				"set keys.sanitize to replace the invalid characters", p.Key, p.source)
+		}
+		checked[i] = p
+		checked[i].Key = key
+	}
+	return checked, nil
+}
+
+// keyValidator leaves the validation of the keys of envs sources to
+// KeyOptions, which reports their source and may sanitize them.
+type keyValidator struct {
+	ifc.Validator
+}
+
+func (keyValidator) IsEnvVarName(string) error {
+	return nil
+}
+
+// FlattenOptions holds the flattening of nested values into keys.
+type FlattenOptions struct {
+	// Maps is either "join", joining the keys of nested maps with the
+	// Separator, as in db.host, or "json", encoding nested maps as JSON.
+	Maps string `json:"maps,omitempty" yaml:"maps,omitempty"`
+
+	// Arrays is either "index", joining the key of an array and the index
+	// of each of its elements with the Separator, as in hosts.0, or "json",
+	// encoding arrays as JSON.
+	Arrays string `json:"arrays,omitempty" yaml:"arrays,omitempty"`
+
+	// Separator joins the keys of nested values, "." by default. "__" gives
+	// DB__HOST style keys.
+	Separator string `json:"separator,omitempty" yaml:"separator,omitempty"`
+}
+
+// flatten appends the pairs of key holding value to pairs, nested values
+// being flattened as configured.
+func (f FlattenOptions) flatten(pairs []types.Pair, key string, value interface{}) ([]types.Pair, error) {
+	separator := f.Separator
+	if separator == "" {
+		separator = "."
+	}
+	switch v := value.(type) {
+	case sops.TreeBranch:
+		switch strings.ToLower(f.Maps) {
+		case "join":
+			var err error
+			for _, item := range v {
+				if _, ok := item.Key.(sops.Comment); ok {
+					continue
+				}
+				k := fmt.Sprint(item.Key)
+				if pairs, err = f.flatten(pairs, key+separator+k, item.Value); err != nil {
+					return nil, err
+				}
+			}
+			return pairs, nil
+		case "json":
+		case "":
+			return nil, fmt.Errorf("key %q holds a map, set flatten.maps to join or json", key)
+		default:
+			return nil, fmt.Errorf("unknown flatten.maps %q, expected join or json", f.Maps)
+		}
+	case []interface{}:
+		switch strings.ToLower(f.Arrays) {
+		case "index":
+			var err error
+			for i, element := range v {
+				if pairs, err = f.flatten(pairs, key+separator+strconv.Itoa(i), element); err != nil {
+					return nil, err
+				}
+			}
+			return pairs, nil
+		case "json":
+		case "":
+			return nil, fmt.Errorf("key %q holds an array, set flatten.arrays to index or json", key)
+		default:
+			return nil, fmt.Errorf("unknown flatten.arrays %q, expected index or json", f.Arrays)
+		}
+	default:
+		s, err := scalarString(value)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", key, err)
+		}
+		return append(pairs, types.Pair{Key: key, Value: s}), nil
+	}
+
+	var buf bytes.Buffer
+	if err := encodeJSON(&buf, value); err != nil {
+		return nil, fmt.Errorf("key %q: %v", key, err)
+	}
+	return append(pairs, types.Pair{Key: key, Value: buf.String()}), nil
+}
+
+// encodeJSON writes value as compact JSON, keeping the order of its maps
+// and dropping comments.
+func encodeJSON(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case sops.TreeBranch:
+		buf.WriteByte('{')
+		first := true
+		for _, item := range v {
+			if _, ok := item.Key.(sops.Comment); ok {
+				continue
+			}
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			encoded, err := json.Marshal(fmt.Sprint(item.Key))
+			if err != nil {
+				return err
+			}
+			buf.Write(encoded)
+			buf.WriteByte(':')
+			if err := encodeJSON(buf, item.Value); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		first := true
+		for _, element := range v {
+			if _, ok := element.(sops.Comment); ok {
+				continue
+			}
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			if err := encodeJSON(buf, element); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(encoded)
+	}
+	return nil
+}
+
+// KeystoreSource builds a PKCS#12 or JKS keystore, holding a private key
+// and its certificate chain, or a truststore when there is no private key.
+type KeystoreSource struct {
+	// Key is the name of the Secret key holding the keystore.
+	Key string `json:"key" yaml:"key"`
+
+	// Format is either "pkcs12" or "jks". It defaults to the one of the Key
+	// extension, .p12, .pfx or .jks.
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+
+	// Alias names the keystore entry, "mykey" by default. The certificates of
+	// a truststore get the alias followed by their index.
+	Alias string `json:"alias,omitempty" yaml:"alias,omitempty"`
+
+	// PrivateKey is the source of the PEM encoded private key.
+	PrivateKey string `json:"privateKey,omitempty" yaml:"privateKey,omitempty"`
+
+	// Certificates are the sources of the PEM encoded certificates, starting
+	// with the certificate of the private key.
+	Certificates []string `json:"certificates" yaml:"certificates"`
+
+	// Password is the source of the keystore password.
+	Password string `json:"password" yaml:"password"`
+}
+
+// TLSOptions holds the validation of the certificate and private key of a
+// sealed/tls Secret. The key must always match the certificate.
+type TLSOptions struct {
+	// OnExpiry is either "fail" (default) or "warn", for an expired certificate.
+	OnExpiry string `json:"onExpiry,omitempty" yaml:"onExpiry,omitempty"`
+
+	// WarnBefore is the Go duration before the certificate expiry from which
+	// a warning is logged, 720h by default.
+	WarnBefore string `json:"warnBefore,omitempty" yaml:"warnBefore,omitempty"`
+
+	// Intermediates are the sources of the intermediate certificates appended
+	// to tls.crt, from the one issuing the certificate up to the root.
+	Intermediates []string `json:"intermediates,omitempty" yaml:"intermediates,omitempty"`
+
+	// KeyFormat converts tls.key to either "pkcs1" or "pkcs8". The key is
+	// left as is by default.
+	KeyFormat string `json:"keyFormat,omitempty" yaml:"keyFormat,omitempty"`
+}
+
+// SSHOptions holds the validation of the ssh-privatekey of a
+// sealed/ssh-auth Secret, and the keys derived from it.
+type SSHOptions struct {
+	// Passphrase is the source of the passphrase protecting the private
+	// key. Passphrase protected keys must be PEM encoded.
+	Passphrase string `json:"passphrase,omitempty" yaml:"passphrase,omitempty"`
+
+	// PublicKey adds the ssh-publickey key, holding the public key in the
+	// authorized_keys format.
+	PublicKey bool `json:"publicKey,omitempty" yaml:"publicKey,omitempty"`
+
+	// KnownHosts adds the known_hosts key, with a line per host key.
+	KnownHosts []KnownHost `json:"knownHosts,omitempty" yaml:"knownHosts,omitempty"`
 }
 
-//noinspection GoUnusedGlobalVariable
+// KnownHost is a known_hosts entry.
+type KnownHost struct {
+	// Hosts are the host names or addresses, with an optional port.
+	Hosts []string `json:"hosts" yaml:"hosts"`
+
+	// Key is the source of the host key, either a public key in the
+	// authorized_keys format or a private key.
+	Key string `json:"key" yaml:"key"`
+}
+
+// SourceOptions holds the policies of a single source, matched by path.
+type SourceOptions struct {
+	Path string `json:"path" yaml:"path"`
+
+	// ExpiresAt is the RFC 3339 time or date after which the source must be rotated.
+	ExpiresAt string `json:"expiresAt,omitempty" yaml:"expiresAt,omitempty"`
+
+	// MaxAge is the longest time, as a Go duration, the source may go
+	// without being modified, according to its SOPS lastmodified metadata.
+	MaxAge string `json:"maxAge,omitempty" yaml:"maxAge,omitempty"`
+
+	// OnExpiry is either "fail" (default) or "warn".
+	OnExpiry string `json:"onExpiry,omitempty" yaml:"onExpiry,omitempty"`
+
+	// Sha256 pins the encrypted content of a remote source. It is required
+	// for every git:: or http(s):// source.
+	Sha256 string `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+
+	// Checksum is the sha256 the decrypted content must have.
+	Checksum string `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+
+	// Binary loads a files source verbatim, where kustomize trims the
+	// trailing whitespace of every line.
+	Binary bool `json:"binary,omitempty" yaml:"binary,omitempty"`
+
+	// Section selects the top-level map of a YAML or JSON envs source, or the
+	// section of an INI one, whose values become keys. INI sources default
+	// to their DEFAULT section.
+	Section string `json:"section,omitempty" yaml:"section,omitempty"`
+}
+
+const (
+	// AuditLogEnv names the environment variable holding the default audit log path.
+	AuditLogEnv = "SEALED_SECRETS_AUDIT_LOG"
+
+	// CacheDirEnv names the environment variable overriding the directory
+	// remote sources are cached in.
+	CacheDirEnv = "SEALED_SECRETS_CACHE_DIR"
+
+	// MaxSecretSize is the largest total size of the values of a Secret
+	// accepted by Kubernetes.
+	MaxSecretSize = 1 << 20
+
+	// SplitManifestKey names the key listing the parts of a split Secret.
+	SplitManifestKey = "manifest.json"
+
+	// DefaultProvenancePrefix is the default prefix of the provenance annotations.
+	DefaultProvenancePrefix = "sealed.secrets/"
+)
+
+// Version is the plugin version recorded in the provenance annotations,
+// set at build time with -ldflags "-X main.Version=<version>".
+var Version = "dev"
+
+// SourceProvenance is the provenance of a single decrypted source, as
+// recorded in the sources annotation.
+type SourceProvenance struct {
+	Path         string    `json:"path"`
+	LastModified time.Time `json:"lastModified"`
+	Keys         []string  `json:"keys,omitempty"`
+}
+
+// noinspection GoUnusedGlobalVariable
 var KustomizePlugin plugin
 
 func (p *plugin) Config(h *resmap.PluginHelpers, config []byte) (err error) {
 	p.GeneratorOptions = types.GeneratorOptions{}
 	p.SecretArgs = types.SecretArgs{}
-	err = yaml.Unmarshal(config, p)
+	p.IgnoreMac = false
+	p.AuditLog = ""
+	p.Sources = nil
+	p.Directories = nil
+	p.Merge = MergeOptions{}
+	p.Vars = nil
+	p.Registries = nil
+	p.Size = SizeOptions{}
+	p.Compression = CompressionOptions{}
+	p.Keys = KeyOptions{}
+	p.Flatten = FlattenOptions{}
+	p.Keystores = nil
+	p.TLS = TLSOptions{}
+	p.SSH = SSHOptions{}
+	p.Immutable = false
+	p.Output = ""
+	p.Strict = false
+	p.Provenance = false
+	p.ProvenancePrefix = ""
+	p.h = h
+	if err = yaml.Unmarshal(config, p); err != nil {
+		return
+	}
+	if p.AuditLog == "" {
+		p.AuditLog = os.Getenv(AuditLogEnv)
+	}
 	if p.SecretArgs.Name == "" {
 		p.SecretArgs.Name = p.Name
 	}
 	if p.SecretArgs.Namespace == "" {
 		p.SecretArgs.Namespace = p.Namespace
 	}
-	p.h = h
+	if err = p.expandVars(); err != nil {
+		return
+	}
+	if len(p.Registries) > 0 && strings.ToLower(p.SecretArgs.Type) != "sealed/dockerconfigjson" {
+		return fmt.Errorf("generator %q: registries are only supported by the sealed/dockerconfigjson type",
+			p.SecretArgs.Name)
+	}
+	switch strings.ToLower(p.SecretArgs.Type) {
+	case "sealed", "sealed/tls", "sealed/ssh-auth", "sealed/dockerconfigjson":
+	default:
+		// Other types read their sources with the kustomize loader, which
+		// would silently skip the integrity checks.
+		for i, source := range p.Sources {
+			if source.Sha256 != "" || source.Checksum != "" {
+				return fmt.Errorf("generator %q: sources[%d]: sha256 and checksum are only verified "+
+					"by the sealed types", p.SecretArgs.Name, i)
+			}
+		}
+	}
+	switch p.Output {
+	case "", "data":
+	case "stringData":
+		if p.Strict {
+			return fmt.Errorf("generator %q: output stringData is not allowed in strict mode",
+				p.SecretArgs.Name)
+		}
+	default:
+		return fmt.Errorf("generator %q: unknown output %q, expected data or stringData",
+			p.SecretArgs.Name, p.Output)
+	}
+	switch strings.ToLower(p.Compression.Codec) {
+	case "", "gzip", "zstd":
+	default:
+		return fmt.Errorf("generator %q: unknown compression codec %q, expected gzip or zstd",
+			p.SecretArgs.Name, p.Compression.Codec)
+	}
+	for _, pattern := range p.Compression.Keys {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("generator %q: compression key pattern %q: %v",
+				p.SecretArgs.Name, pattern, err)
+		}
+	}
+	if p.Immutable && p.GeneratorOptions.DisableNameSuffixHash {
+		return fmt.Errorf("generator %q: immutable Secrets need a name suffix hash, "+
+			"disableNameSuffixHash cannot be set", p.SecretArgs.Name)
+	}
+	// Kustomize would append its hash suffix to each part, so that the
+	// names would no longer match the manifest.
+	if p.Size.Split && !p.GeneratorOptions.DisableNameSuffixHash {
+		return fmt.Errorf("generator %q: split Secrets are listed by name in their manifest, "+
+			"size.split needs disableNameSuffixHash", p.SecretArgs.Name)
+	}
+	// Kustomize only hashes data, changing a stringData value would keep
+	// the name of the immutable Secret.
+	if p.Immutable && p.Output == "stringData" {
+		return fmt.Errorf("generator %q: immutable Secrets need their values hashed, "+
+			"output stringData cannot be set", p.SecretArgs.Name)
+	}
+	// The behavior is matched by kustomize against the Secret generated with
+	// the same name by a base, and silently ignored unless lower case.
+	p.SecretArgs.Behavior = strings.ToLower(p.SecretArgs.Behavior)
+	if p.SecretArgs.Behavior != "" &&
+		types.NewGenerationBehavior(p.SecretArgs.Behavior) == types.BehaviorUnspecified {
+		return fmt.Errorf("generator %q: unknown behavior %q, expected create, replace or merge",
+			p.SecretArgs.Name, p.SecretArgs.Behavior)
+	}
 	return
 }
 
 func (p *plugin) Generate() (resmap.ResMap, error) {
+	p.decrypted = nil
+	now := time.Now()
+	rm, err := p.generate()
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(p.SecretArgs.Type) {
+	case "sealed/tls":
+		for _, res := range rm.Resources() {
+			if err := p.validateTLS(res, now); err != nil {
+				return nil, err
+			}
+		}
+	case "sealed/ssh-auth":
+		for _, res := range rm.Resources() {
+			if err := p.validateSSH(res); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := p.checkExpiry(now); err != nil {
+		return nil, err
+	}
+	if p.Compression.Codec != "" {
+		for _, res := range rm.Resources() {
+			if err := p.compress(res); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.Immutable {
+		for _, res := range rm.Resources() {
+			m := res.Map()
+			m["immutable"] = true
+			res.SetMap(m)
+		}
+	}
+	if p.Output == "stringData" {
+		for _, res := range rm.Resources() {
+			if err := toStringData(res); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.Provenance {
+		if err := p.annotateProvenance(rm); err != nil {
+			return nil, err
+		}
+	}
+	return p.checkSize(rm)
+}
+
+func (p *plugin) generate() (resmap.ResMap, error) {
+	var ldr ifc.Loader
+	args := p.SecretArgs
 	switch strings.ToLower(p.SecretArgs.Type) {
 	case "sealed":
-		return p.h.ResmapFactory().FromSecretArgs(
-			kv.NewLoader(NewSopsLoader(p.h.Loader()), p.h.Validator()),
-			&p.GeneratorOptions, types.SecretArgs{
-				GeneratorArgs: p.SecretArgs.GeneratorArgs,
-			})
+		ldr = p.sopsLoader()
+		args = types.SecretArgs{
+			GeneratorArgs: p.SecretArgs.GeneratorArgs,
+		}
 	case "sealed/tls":
-		return p.h.ResmapFactory().FromSecretArgs(
-			kv.NewLoader(NewSopsLoader(p.h.Loader()), p.h.Validator()),
-			&p.GeneratorOptions, types.SecretArgs{
-				GeneratorArgs: p.SecretArgs.GeneratorArgs,
-				Type:          "kubernetes.io/tls",
-			})
+		ldr = p.sopsLoader()
+		args = types.SecretArgs{
+			GeneratorArgs: p.SecretArgs.GeneratorArgs,
+			Type:          "kubernetes.io/tls",
+		}
+	case "sealed/ssh-auth":
+		ldr = p.sopsLoader()
+		args = types.SecretArgs{
+			GeneratorArgs: p.SecretArgs.GeneratorArgs,
+			Type:          "kubernetes.io/ssh-auth",
+		}
+	case "sealed/dockerconfigjson":
+		ldr = p.sopsLoader()
+		args = types.SecretArgs{
+			GeneratorArgs: p.SecretArgs.GeneratorArgs,
+			Type:          "kubernetes.io/dockerconfigjson",
+		}
 	default:
-		return p.h.ResmapFactory().FromSecretArgs(
-			kv.NewLoader(p.h.Loader(), p.h.Validator()),
-			&p.GeneratorOptions, p.SecretArgs)
+		ldr = p.h.Loader()
+	}
+	kvl := p.kvLoader(ldr)
+	sources, err := kvl.expandGlobs(args.KvPairSources)
+	if err != nil {
+		return nil, err
 	}
+	args.KvPairSources = sources
+	return p.h.ResmapFactory().FromSecretArgs(kvl, &p.GeneratorOptions, args)
 }
 
-type SopsLoader struct {
-	proxy ifc.Loader
+// kvLoader returns a KvLoader reading this generator's sources through ldr.
+func (p *plugin) kvLoader(ldr ifc.Loader) *kvLoader {
+	sources := map[string]SourceOptions{}
+	for _, source := range p.Sources {
+		sources[source.Path] = source
+	}
+	return &kvLoader{
+		KvLoader:    kv.NewLoader(ldr, keyValidator{p.h.Validator()}),
+		ldr:         ldr,
+		fSys:        filesys.MakeFsOnDisk(),
+		sources:     sources,
+		directories: p.Directories,
+		merge:       p.Merge,
+		registries:  p.Registries,
+		keystores:   p.Keystores,
+		flatten:     p.Flatten,
+		keys:        p.Keys,
+	}
 }
 
-func NewSopsLoader(proxy ifc.Loader) *SopsLoader {
-	return &SopsLoader{proxy: proxy}
+// varReference matches a ${VAR} reference. Any other "$" is kept as is.
+var varReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandVars expands the ${VAR} references of the configuration. Literal
+// values are left untouched, as they may legitimately contain "$".
+func (p *plugin) expandVars() error {
+	var missing []string
+	expand := func(s string) string {
+		return varReference.ReplaceAllStringFunc(s, func(ref string) string {
+			name := varReference.FindStringSubmatch(ref)[1]
+			if value, ok := os.LookupEnv(name); ok {
+				return value
+			}
+			if value, ok := p.Vars[name]; ok {
+				return value
+			}
+			missing = append(missing, name)
+			return ""
+		})
+	}
+	expandAll := func(values []string) {
+		for i := range values {
+			values[i] = expand(values[i])
+		}
+	}
+	expandMap := func(m map[string]string) map[string]string {
+		if m == nil {
+			return nil
+		}
+		expanded := make(map[string]string, len(m))
+		for k, v := range m {
+			expanded[expand(k)] = expand(v)
+		}
+		return expanded
+	}
+
+	p.SecretArgs.Name = expand(p.SecretArgs.Name)
+	p.SecretArgs.Namespace = expand(p.SecretArgs.Namespace)
+	p.GeneratorOptions.Labels = expandMap(p.GeneratorOptions.Labels)
+	p.GeneratorOptions.Annotations = expandMap(p.GeneratorOptions.Annotations)
+	expandAll(p.SecretArgs.EnvSources)
+	expandAll(p.SecretArgs.FileSources)
+	expandAll(p.Registries)
+	for i := range p.Keystores {
+		p.Keystores[i].PrivateKey = expand(p.Keystores[i].PrivateKey)
+		expandAll(p.Keystores[i].Certificates)
+		p.Keystores[i].Password = expand(p.Keystores[i].Password)
+	}
+	expandAll(p.TLS.Intermediates)
+	p.SSH.Passphrase = expand(p.SSH.Passphrase)
+	for i := range p.SSH.KnownHosts {
+		p.SSH.KnownHosts[i].Key = expand(p.SSH.KnownHosts[i].Key)
+	}
+	for i := range p.Directories {
+		p.Directories[i].Path = expand(p.Directories[i].Path)
+	}
+	for i := range p.Sources {
+		p.Sources[i].Path = expand(p.Sources[i].Path)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("generator %q: undefined variables %s",
+			p.SecretArgs.Name, strings.Join(missing, ", "))
+	}
+	return nil
 }
 
-func (sl *SopsLoader) Root() string {
-	return sl.proxy.Root()
+// sopsLoader returns a SopsLoader configured for this generator.
+func (p *plugin) sopsLoader() *SopsLoader {
+	sl := NewSopsLoader(p.h.Loader())
+	sl.generator = p.SecretArgs.Name
+	sl.ignoreMac = p.IgnoreMac
+	sl.auditLog = p.AuditLog
+	sl.decrypted = &p.decrypted
+	sl.pins = map[string]string{}
+	sl.checksums = map[string]string{}
+	for _, source := range p.Sources {
+		if source.Sha256 != "" {
+			sl.pins[source.Path] = strings.ToLower(source.Sha256)
+		}
+		if source.Checksum != "" {
+			sl.checksums[source.Path] = strings.ToLower(source.Checksum)
+		}
+	}
+	return sl
 }
 
-// New returns Loader located at newRoot.
-func (sl *SopsLoader) New(newRoot string) (ifc.Loader, error) {
-	p, err := sl.proxy.New(newRoot)
+// checkExpiry enforces the rotation policies of Sources against the
+// sources decrypted by the last generation.
+func (p *plugin) checkExpiry(now time.Time) error {
+	for i, source := range p.Sources {
+		if source.ExpiresAt == "" && source.MaxAge == "" {
+			continue
+		}
+		d := p.findDecryption(source.Path)
+		if d == nil {
+			return fmt.Errorf("sources[%d]: %q was not decrypted by generator %q",
+				i, source.Path, p.SecretArgs.Name)
+		}
+
+		var problems []string
+		if source.ExpiresAt != "" {
+			expiresAt, err := parseExpiresAt(source.ExpiresAt)
+			if err != nil {
+				return fmt.Errorf("sources[%d]: invalid expiresAt: %v", i, err)
+			}
+			if now.After(expiresAt) {
+				problems = append(problems, fmt.Sprintf(
+					"expired at %s", expiresAt.Format(time.RFC3339)))
+			}
+		}
+		if source.MaxAge != "" {
+			maxAge, err := time.ParseDuration(source.MaxAge)
+			if err != nil {
+				return fmt.Errorf("sources[%d]: invalid maxAge: %v", i, err)
+			}
+			if now.Sub(d.LastModified) > maxAge {
+				problems = append(problems, fmt.Sprintf(
+					"last modified at %s, more than %s ago",
+					d.LastModified.Format(time.RFC3339), source.MaxAge))
+			}
+		}
+		if len(problems) == 0 {
+			continue
+		}
+
+		msg := fmt.Sprintf("generator %q: source %q %s",
+			p.SecretArgs.Name, source.Path, strings.Join(problems, " and "))
+		switch strings.ToLower(source.OnExpiry) {
+		case "", "fail":
+			return fmt.Errorf("%s", msg)
+		case "warn":
+			log.Printf("warning: %s", msg)
+		default:
+			return fmt.Errorf("sources[%d]: unknown onExpiry %q", i, source.OnExpiry)
+		}
+	}
+	return nil
+}
+
+func (p *plugin) annotationPrefix() string {
+	if p.ProvenancePrefix == "" {
+		return DefaultProvenancePrefix
+	}
+	return p.ProvenancePrefix
+}
+
+// annotateProvenance records on every resource of rm the sources decrypted
+// by the last generation, and the plugin version.
+func (p *plugin) annotateProvenance(rm resmap.ResMap) error {
+	prefix := p.annotationPrefix()
+	sources := []SourceProvenance{}
+	seen := map[string]bool{}
+	for _, d := range p.decrypted {
+		if seen[d.Location] {
+			continue
+		}
+		seen[d.Location] = true
+		sources = append(sources, SourceProvenance{
+			Path:         d.Location,
+			LastModified: d.LastModified.UTC(),
+			Keys:         d.Keys,
+		})
+	}
+	encoded, err := json.Marshal(sources)
 	if err != nil {
-		return &SopsLoader{}, err
+		return err
 	}
-	return NewSopsLoader(p), nil
+	for _, res := range rm.Resources() {
+		annotations := res.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[prefix+"sources"] = string(encoded)
+		annotations[prefix+"version"] = Version
+		res.SetAnnotations(annotations)
+	}
+	return nil
 }
 
-// Load returns the bytes read from the location or an error.
-func (sl *SopsLoader) Load(location string) ([]byte, error) {
-	bytes, err := sl.proxy.Load(location)
+// checkSize fails when a Secret of rm is larger than the size limit, or
+// splits it if enabled.
+func (p *plugin) checkSize(rm resmap.ResMap) (resmap.ResMap, error) {
+	limit := p.Size.Limit
+	if limit == 0 {
+		limit = MaxSecretSize
+	}
+	checked := resmap.New()
+	for _, res := range rm.Resources() {
+		size := secretSize(res)
+		if size <= limit {
+			if err := checked.Append(res); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !p.Size.Split {
+			return nil, fmt.Errorf("generator %q: Secret %q is %d bytes, over the limit of %d bytes, "+
+				"set size.split to split it:\n%s",
+				p.SecretArgs.Name, res.GetName(), size, limit, sizeBreakdown(res))
+		}
+		parts, err := splitSecret(res, limit)
+		if err != nil {
+			return nil, fmt.Errorf("generator %q: %v", p.SecretArgs.Name, err)
+		}
+		for _, part := range parts {
+			if err := checked.Append(part); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return checked, nil
+}
+
+// secretSize returns the size Kubernetes limits, the total of the decoded
+// values of res.
+func secretSize(res *resource.Resource) int {
+	size := 0
+	for _, s := range secretValues(res) {
+		size += s
+	}
+	return size
+}
+
+// secretValues returns the decoded size of each value of the data and
+// stringData of res.
+func secretValues(res *resource.Resource) map[string]int {
+	sizes := map[string]int{}
+	for _, field := range []string{"data", "stringData"} {
+		values, _ := res.Map()[field].(map[string]interface{})
+		for key, value := range values {
+			s, _ := value.(string)
+			sizes[key] = len(s)
+			if field == "data" {
+				if decoded, err := base64.StdEncoding.DecodeString(s); err == nil {
+					sizes[key] = len(decoded)
+				}
+			}
+		}
+	}
+	return sizes
+}
+
+// sizeBreakdown lists the keys of res from the largest to the smallest.
+func sizeBreakdown(res *resource.Resource) string {
+	sizes := secretValues(res)
+	keys := sortedKeys(sizes)
+	sort.SliceStable(keys, func(i, j int) bool { return sizes[keys[i]] > sizes[keys[j]] })
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("  %s: %d bytes", key, sizes[key]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func sortedKeys(m map[string]int) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// splitSecret spreads the keys of res, in order, across Secrets under the
+// limit. The first one lists them all under the SplitManifestKey key.
+func splitSecret(res *resource.Resource, limit int) ([]*resource.Resource, error) {
+	sizes := secretValues(res)
+	if _, exists := sizes[SplitManifestKey]; exists {
+		return nil, fmt.Errorf("key %q is reserved to the manifest of split Secrets", SplitManifestKey)
+	}
+
+	// Keys are assigned greedily, leaving room in the first part for the
+	// manifest, as large as when each key gets a part of its own. Each part
+	// is checked once built.
+	keys := sortedKeys(sizes)
+	var largest []SplitPart
+	for i, key := range keys {
+		largest = append(largest, SplitPart{
+			Name: fmt.Sprintf("%s-%d", res.GetName(), i),
+			Keys: []string{key},
+		})
+	}
+	encodedLargest, err := json.Marshal(largest)
 	if err != nil {
 		return nil, err
 	}
 
-	return decrypt.DataWithFormat(bytes, formats.FormatForPath(location))
+	var manifest []SplitPart
+	partSize := 0
+	for _, key := range keys {
+		size := sizes[key]
+		if len(manifest) == 0 || partSize+size > limit {
+			partSize = 0
+			if len(manifest) == 0 {
+				partSize = len(encodedLargest)
+			}
+			manifest = append(manifest, SplitPart{
+				Name: fmt.Sprintf("%s-%d", res.GetName(), len(manifest)),
+			})
+		}
+		last := &manifest[len(manifest)-1]
+		last.Keys = append(last.Keys, key)
+		partSize += size
+	}
+	encodedManifest, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []*resource.Resource
+	for i, part := range manifest {
+		partRes := res.DeepCopy()
+		partRes.SetName(part.Name)
+		m := partRes.Map()
+		for _, field := range []string{"data", "stringData"} {
+			values, ok := m[field].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			kept := map[string]interface{}{}
+			for _, key := range part.Keys {
+				if value, ok := values[key]; ok {
+					kept[key] = value
+				}
+			}
+			if len(kept) == 0 {
+				delete(m, field)
+			} else {
+				m[field] = kept
+			}
+		}
+		if i == 0 {
+			data, _ := m["data"].(map[string]interface{})
+			if data == nil {
+				data = map[string]interface{}{}
+			}
+			data[SplitManifestKey] = base64.StdEncoding.EncodeToString(encodedManifest)
+			m["data"] = data
+		}
+		partRes.SetMap(m)
+		if size := secretSize(partRes); size > limit {
+			return nil, fmt.Errorf("Secret %q is %d bytes, over the limit of %d bytes, "+
+				"even split:\n%s", part.Name, size, limit, sizeBreakdown(partRes))
+		}
+		parts = append(parts, partRes)
+	}
+	return parts, nil
+}
+
+// validateTLS checks that the tls.key of res matches its tls.crt, which
+// must not be expired, then appends the intermediate certificates to
+// tls.crt and converts tls.key as configured.
+func (p *plugin) validateTLS(res *resource.Resource, now time.Time) error {
+	fail := func(format string, args ...interface{}) error {
+		return fmt.Errorf("generator %q: %s", p.SecretArgs.Name, fmt.Sprintf(format, args...))
+	}
+	m := res.Map()
+	data, _ := m["data"].(map[string]interface{})
+	decode := func(key string) ([]byte, error) {
+		encoded, _ := data[key].(string)
+		return base64.StdEncoding.DecodeString(encoded)
+	}
+	certPEM, err := decode("tls.crt")
+	if err != nil {
+		return fail("tls.crt: %v", err)
+	}
+	keyPEM, err := decode("tls.key")
+	if err != nil {
+		return fail("tls.key: %v", err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fail("invalid tls.crt and tls.key: %v", err)
+	}
+	var chain []*x509.Certificate
+	for _, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fail("tls.crt: %v", err)
+		}
+		chain = append(chain, cert)
+	}
+	leaf := chain[0]
+
+	warnBefore := 30 * 24 * time.Hour
+	if p.TLS.WarnBefore != "" {
+		if warnBefore, err = time.ParseDuration(p.TLS.WarnBefore); err != nil {
+			return fail("invalid tls.warnBefore: %v", err)
+		}
+	}
+	switch expiry := leaf.NotAfter.Format(time.RFC3339); {
+	case now.After(leaf.NotAfter):
+		msg := fmt.Sprintf("certificate %q expired at %s", leaf.Subject.CommonName, expiry)
+		switch strings.ToLower(p.TLS.OnExpiry) {
+		case "", "fail":
+			return fail("%s", msg)
+		case "warn":
+			log.Printf("warning: generator %q: %s", p.SecretArgs.Name, msg)
+		default:
+			return fail("unknown tls.onExpiry %q", p.TLS.OnExpiry)
+		}
+	case leaf.NotAfter.Sub(now) < warnBefore:
+		log.Printf("warning: generator %q: certificate %q expires at %s",
+			p.SecretArgs.Name, leaf.Subject.CommonName, expiry)
+	}
+
+	if len(p.TLS.Intermediates) > 0 {
+		ldr := p.sopsLoader()
+		for _, source := range p.TLS.Intermediates {
+			content, err := ldr.Load(source)
+			if err != nil {
+				return fail("intermediate %q: %v", source, err)
+			}
+			certs, err := parseCertificates(content)
+			if err != nil {
+				return fail("intermediate %q: %v", source, err)
+			}
+			chain = append(chain, certs...)
+			certPEM = append(bytes.TrimRight(certPEM, "\n"), '\n')
+			certPEM = append(certPEM, bytes.TrimSpace(content)...)
+		}
+		data["tls.crt"] = base64.StdEncoding.EncodeToString(certPEM)
+	}
+	for i := 0; i+1 < len(chain); i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return fail("certificate %q is not issued by %q: %v",
+				chain[i].Subject.CommonName, chain[i+1].Subject.CommonName, err)
+		}
+	}
+
+	if p.TLS.KeyFormat != "" {
+		block, err := convertKey(pair.PrivateKey, strings.ToLower(p.TLS.KeyFormat))
+		if err != nil {
+			return fail("tls.key: %v", err)
+		}
+		data["tls.key"] = base64.StdEncoding.EncodeToString(pem.EncodeToMemory(block))
+	}
+	res.SetMap(m)
+	return nil
+}
+
+// validateSSH checks that the ssh-privatekey of res parses, then adds the
+// public key and known hosts as configured.
+func (p *plugin) validateSSH(res *resource.Resource) error {
+	fail := func(format string, args ...interface{}) error {
+		return fmt.Errorf("generator %q: %s", p.SecretArgs.Name, fmt.Sprintf(format, args...))
+	}
+	m := res.Map()
+	data, _ := m["data"].(map[string]interface{})
+	encoded, ok := data["ssh-privatekey"].(string)
+	if !ok {
+		return fail("no ssh-privatekey key")
+	}
+	keyPEM, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fail("ssh-privatekey: %v", err)
+	}
+	ldr := p.sopsLoader()
+	var passphrase []byte
+	if p.SSH.Passphrase != "" {
+		if passphrase, err = ldr.Load(p.SSH.Passphrase); err != nil {
+			return fail("passphrase %q: %v", p.SSH.Passphrase, err)
+		}
+		passphrase = bytes.TrimRight(passphrase, "\r\n")
+	}
+	signer, err := parseSSHPrivateKey(keyPEM, passphrase)
+	if err != nil {
+		return fail("ssh-privatekey: %v", err)
+	}
+
+	add := func(key, value string) error {
+		if _, exists := data[key]; exists {
+			return fail("key %q is already defined", key)
+		}
+		data[key] = base64.StdEncoding.EncodeToString([]byte(value))
+		return nil
+	}
+	if p.SSH.PublicKey {
+		if err := add("ssh-publickey", string(ssh.MarshalAuthorizedKey(signer.PublicKey()))); err != nil {
+			return err
+		}
+	}
+	if len(p.SSH.KnownHosts) > 0 {
+		var lines []string
+		for _, host := range p.SSH.KnownHosts {
+			content, err := ldr.Load(host.Key)
+			if err != nil {
+				return fail("host key %q: %v", host.Key, err)
+			}
+			key, _, _, _, err := ssh.ParseAuthorizedKey(content)
+			if err != nil {
+				hostSigner, signerErr := ssh.ParsePrivateKey(content)
+				if signerErr != nil {
+					return fail("host key %q: neither a public key (%v) nor a private key (%v)",
+						host.Key, err, signerErr)
+				}
+				key = hostSigner.PublicKey()
+			}
+			lines = append(lines, knownhosts.Line(host.Hosts, key))
+		}
+		if err := add("known_hosts", strings.Join(lines, "\n")+"\n"); err != nil {
+			return err
+		}
+	}
+	res.SetMap(m)
+	return nil
+}
+
+// parseSSHPrivateKey parses a private key, decrypting it with passphrase
+// when it is protected by one.
+func parseSSHPrivateKey(keyPEM, passphrase []byte) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(keyPEM)
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+		return signer, err
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("the key is protected by a passphrase, set ssh.passphrase")
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(keyPEM, passphrase)
+}
+
+// parseCertificates parses the PEM encoded certificates of content.
+func parseCertificates(content []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+	return certs, nil
+}
+
+// convertKey encodes key in the given format, either pkcs1 or pkcs8.
+func convertKey(key crypto.PrivateKey, format string) (*pem.Block, error) {
+	switch format {
+	case "pkcs1":
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("only RSA keys can be encoded as pkcs1, got %T", key)
+		}
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, nil
+	case "pkcs8":
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	default:
+		return nil, fmt.Errorf("unknown key format %q, expected pkcs1 or pkcs8", format)
+	}
+}
+
+// compress compresses the selected data values of res, and records them in
+// the compression annotation.
+func (p *plugin) compress(res *resource.Resource) error {
+	codec := strings.ToLower(p.Compression.Codec)
+	m := res.Map()
+	data, _ := m["data"].(map[string]interface{})
+	compressed := map[string]string{}
+	for key, value := range data {
+		if !p.Compression.matches(key) {
+			continue
+		}
+		encoded, _ := value.(string)
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", key, err)
+		}
+		if len(decoded) < p.Compression.MinSize {
+			continue
+		}
+		var out []byte
+		if codec == "zstd" {
+			out, err = zstdBytes(decoded)
+		} else {
+			out, err = gzipBytes(decoded)
+		}
+		if err != nil {
+			return fmt.Errorf("generator %q: key %q: %v", p.SecretArgs.Name, key, err)
+		}
+		if len(out) >= len(decoded) {
+			continue
+		}
+		data[key] = base64.StdEncoding.EncodeToString(out)
+		compressed[key] = codec
+	}
+	if len(compressed) == 0 {
+		return nil
+	}
+	res.SetMap(m)
+	encoded, err := json.Marshal(compressed)
+	if err != nil {
+		return err
+	}
+	annotations := res.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[p.annotationPrefix()+"compression"] = string(encoded)
+	res.SetAnnotations(annotations)
+	return nil
+}
+
+// gzipBytes compresses b without a name or modification time in the
+// header, so that the output only depends on b.
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// zstdBytes compresses b in a single frame, so that the output only
+// depends on b.
+func zstdBytes(b []byte) ([]byte, error) {
+	w, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	return w.EncodeAll(b, nil), nil
+}
+
+// toStringData moves the UTF-8 values of the data of res to its stringData.
+func toStringData(res *resource.Resource) error {
+	m := res.Map()
+	data, _ := m["data"].(map[string]interface{})
+	stringData := map[string]interface{}{}
+	for key, value := range data {
+		encoded, _ := value.(string)
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", key, err)
+		}
+		if !utf8.Valid(decoded) {
+			continue
+		}
+		stringData[key] = string(decoded)
+		delete(data, key)
+	}
+	if len(stringData) == 0 {
+		return nil
+	}
+	m["stringData"] = stringData
+	if len(data) == 0 {
+		delete(m, "data")
+	}
+	res.SetMap(m)
+	return nil
+}
+
+func (p *plugin) findDecryption(location string) *decryption {
+	for i := range p.decrypted {
+		if filepath.Clean(p.decrypted[i].Location) == filepath.Clean(location) {
+			return &p.decrypted[i]
+		}
+	}
+	return nil
+}
+
+func parseExpiresAt(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// DecryptFailure classifies why a source could not be decrypted.
+type DecryptFailure string
+
+const (
+	NoMatchingKey     DecryptFailure = "no matching key"
+	MacMismatch       DecryptFailure = "MAC mismatch"
+	CorruptCiphertext DecryptFailure = "corrupt ciphertext"
+	UnsupportedFormat DecryptFailure = "unsupported format"
+)
+
+// DecryptError is returned by SopsLoader.Load when a source cannot be decrypted.
+type DecryptError struct {
+	Generator string
+	Path      string
+	Format    string
+	Reason    DecryptFailure
+	Err       error
+}
+
+func (e *DecryptError) Error() string {
+	return fmt.Sprintf("generator %q: unable to decrypt %q as %s: %s: %v",
+		e.Generator, e.Path, e.Format, e.Reason, e.Err)
+}
+
+func (e *DecryptError) Unwrap() error {
+	return e.Err
+}
+
+var formatNames = map[formats.Format]string{
+	formats.Binary: "binary",
+	formats.Dotenv: "dotenv",
+	formats.Ini:    "ini",
+	formats.Json:   "json",
+	formats.Yaml:   "yaml",
+}
+
+// AuditEvent records a single decryption. It never holds plaintext.
+type AuditEvent struct {
+	Time      time.Time      `json:"time"`
+	Generator string         `json:"generator"`
+	Path      string         `json:"path"`
+	Format    string         `json:"format"`
+	Keys      []string       `json:"keys,omitempty"`
+	Failure   DecryptFailure `json:"failure,omitempty"`
+}
+
+// kvLoader extends the kustomize KvLoader with the sources it does not
+// support, and merges the keys defined by several sources.
+type kvLoader struct {
+	ifc.KvLoader
+	ldr         ifc.Loader
+	fSys        filesys.FileSystem
+	sources     map[string]SourceOptions
+	directories []DirectorySource
+	merge       MergeOptions
+	registries  []string
+	keystores   []KeystoreSource
+	flatten     FlattenOptions
+	keys        KeyOptions
+}
+
+// pair is a key value pair along with the source it was read from.
+type pair struct {
+	types.Pair
+	source string
+}
+
+// Load reads the sources from the lowest to the highest precedence: envs,
+// files, directories, keystores, registries and literals, each in the order
+// they are listed.
+func (kvl *kvLoader) Load(args types.KvPairSources) ([]types.Pair, error) {
+	var all []pair
+	for _, s := range args.EnvSources {
+		var pairs []types.Pair
+		var err error
+		switch format := formats.FormatForPath(sourceFile(s)); format {
+		case formats.Yaml, formats.Json, formats.Ini:
+			pairs, err = kvl.keyValuesFromStructuredFile(s, format)
+			if err != nil {
+				err = fmt.Errorf("env source %q: %v", s, err)
+			}
+		default:
+			pairs, err = kvl.KvLoader.Load(types.KvPairSources{EnvSources: []string{s}})
+		}
+		if err != nil {
+			return nil, err
+		}
+		all = appendPairs(all, s, pairs)
+	}
+	for _, s := range args.FileSources {
+		key, location := parseRemoteFileSource(s)
+		if !isRemote(location) && !kvl.sources[location].Binary {
+			pairs, err := kvl.KvLoader.Load(types.KvPairSources{FileSources: []string{s}})
+			if err != nil {
+				return nil, err
+			}
+			all = appendPairs(all, s, pairs)
+			continue
+		}
+		// Remote and binary sources are loaded verbatim, kustomize parsing
+		// neither URLs nor binary content.
+		content, err := kvl.ldr.Load(location)
+		if err != nil {
+			return nil, fmt.Errorf("file source %q: %v", s, err)
+		}
+		all = append(all, pair{types.Pair{Key: key, Value: string(content)}, location})
+	}
+	for _, dir := range kvl.directories {
+		pairs, err := kvl.keyValuesFromDirectory(dir)
+		if err != nil {
+			return nil, fmt.Errorf("directory source %q: %v", dir.Path, err)
+		}
+		all = append(all, pairs...)
+	}
+	for _, ks := range kvl.keystores {
+		content, err := kvl.keystore(ks)
+		if err != nil {
+			return nil, fmt.Errorf("keystore %q: %v", ks.Key, err)
+		}
+		all = append(all, pair{types.Pair{Key: ks.Key, Value: string(content)}, "keystores"})
+	}
+	if len(kvl.registries) > 0 {
+		config, err := kvl.dockerConfigJSON()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, pair{types.Pair{Key: ".dockerconfigjson", Value: config}, "registries"})
+	}
+	for _, s := range args.LiteralSources {
+		pairs, err := kvl.KvLoader.Load(types.KvPairSources{LiteralSources: []string{s}})
+		if err != nil {
+			return nil, err
+		}
+		all = appendPairs(all, "literals", pairs)
+	}
+	all, err := kvl.keys.check(all)
+	if err != nil {
+		return nil, err
+	}
+	return kvl.mergePairs(all)
+}
+
+func appendPairs(all []pair, source string, pairs []types.Pair) []pair {
+	for _, p := range pairs {
+		all = append(all, pair{p, source})
+	}
+	return all
+}
+
+// mergePairs resolves the keys defined more than once according to the
+// merge behavior of each key.
+func (kvl *kvLoader) mergePairs(all []pair) ([]types.Pair, error) {
+	var merged []types.Pair
+	seen := map[string]int{}
+	sources := map[string]string{}
+	for _, p := range all {
+		i, exists := seen[p.Key]
+		if !exists {
+			seen[p.Key] = len(merged)
+			sources[p.Key] = p.source
+			merged = append(merged, p.Pair)
+			continue
+		}
+		behavior, err := kvl.merge.behaviorFor(p.Key)
+		if err != nil {
+			return nil, err
+		}
+		if behavior != "replace" {
+			return nil, fmt.Errorf(
+				"key %q from %q conflicts with %q, set its merge behavior to replace to override it",
+				p.Key, p.source, sources[p.Key])
+		}
+		merged[i] = p.Pair
+		sources[p.Key] = p.source
+	}
+	return merged, nil
+}
+
+// keystore builds the keystore described by ks from its sources.
+func (kvl *kvLoader) keystore(ks KeystoreSource) ([]byte, error) {
+	format := strings.ToLower(ks.Format)
+	if format == "" {
+		switch strings.ToLower(path.Ext(ks.Key)) {
+		case ".p12", ".pfx":
+			format = "pkcs12"
+		case ".jks":
+			format = "jks"
+		default:
+			return nil, fmt.Errorf("no format given, and none implied by the key extension")
+		}
+	}
+	alias := ks.Alias
+	if alias == "" {
+		alias = "mykey"
+	}
+	if len(ks.Certificates) == 0 {
+		return nil, fmt.Errorf("no certificates")
+	}
+	load := func(source string) ([]byte, error) {
+		content, err := kvl.ldr.Load(source)
+		if err != nil {
+			return nil, fmt.Errorf("source %q: %v", source, err)
+		}
+		return content, nil
+	}
+	password, err := load(ks.Password)
+	if err != nil {
+		return nil, err
+	}
+	var certPEM []byte
+	for _, source := range ks.Certificates {
+		content, err := load(source)
+		if err != nil {
+			return nil, err
+		}
+		certPEM = append(append(certPEM, content...), '\n')
+	}
+	certs, err := parseCertificates(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	var key crypto.PrivateKey
+	if ks.PrivateKey != "" {
+		keyPEM, err := load(ks.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		key = pair.PrivateKey
+	}
+	keystore := javaKeystore{
+		Alias:        alias,
+		PrivateKey:   key,
+		Certificates: certs,
+		Password:     strings.TrimRight(string(password), "\r\n"),
+	}
+	switch format {
+	case "pkcs12":
+		return keystore.pkcs12()
+	case "jks":
+		return keystore.jks()
+	default:
+		return nil, fmt.Errorf("unknown format %q, expected pkcs12 or jks", ks.Format)
+	}
+}
+
+// javaKeystore is a keystore holding a private key and its certificate
+// chain, or a truststore holding certificates only. Its encodings are
+// deterministic, salts being derived from its content, so that the same
+// sources always give the same Secret.
+type javaKeystore struct {
+	Alias        string
+	PrivateKey   crypto.PrivateKey
+	Certificates []*x509.Certificate
+	Password     string
+}
+
+var (
+	oidData                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidShroudedKeyBag       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidJavaTrustedKeyUsage  = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+	oidAnyExtendedKeyUsage  = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+	oidPBEWithSHAAnd3DESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidJKSKeyProtector      = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+)
+
+const pkcs12Iterations = 2048
+
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type pkcs12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type pkcs12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pkcs12MacData struct {
+	Mac struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Digest    []byte
+	}
+	Salt       []byte
+	Iterations int
+}
+
+type pkcs12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// explicit wraps the DER encoding der in an explicit context specific tag 0.
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// set wraps the DER encoding der in a SET.
+func set(der []byte) asn1.RawValue {
+	return asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: der}
+}
+
+// pkcs12 encodes the keystore as a PKCS#12 file, the private key being
+// encrypted with pbeWithSHAAnd3-KeyTripleDES-CBC and the file authenticated
+// with an HMAC-SHA1, as expected by Java and OpenSSL.
+func (ks javaKeystore) pkcs12() ([]byte, error) {
+	password := bmpString(ks.Password)
+	var certBags, keyBags []pkcs12SafeBag
+	for i, cert := range ks.Certificates {
+		der, err := asn1.Marshal(pkcs12CertBag{ID: oidX509Certificate, Data: cert.Raw})
+		if err != nil {
+			return nil, err
+		}
+		bag := pkcs12SafeBag{ID: oidCertBag, Value: explicit(der)}
+		switch {
+		case ks.PrivateKey == nil:
+			usage, err := asn1.Marshal(oidAnyExtendedKeyUsage)
+			if err != nil {
+				return nil, err
+			}
+			bag.Attributes = []pkcs12Attribute{
+				friendlyName(truststoreAlias(ks.Alias, i, len(ks.Certificates))),
+				{ID: oidJavaTrustedKeyUsage, Value: set(usage)},
+			}
+		case i == 0:
+			if bag.Attributes, err = ks.keyAttributes(); err != nil {
+				return nil, err
+			}
+		}
+		certBags = append(certBags, bag)
+	}
+
+	if ks.PrivateKey != nil {
+		plain, err := x509.MarshalPKCS8PrivateKey(ks.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		salt := derivedSalt("pkcs12 key", ks.Certificates[0].Raw)
+		params, err := asn1.Marshal(pkcs12PBEParams{Salt: salt, Iterations: pkcs12Iterations})
+		if err != nil {
+			return nil, err
+		}
+		block, err := des.NewTripleDESCipher(pkcs12KDF(password, salt, 1, pkcs12Iterations, 24))
+		if err != nil {
+			return nil, err
+		}
+		padding := block.BlockSize() - len(plain)%block.BlockSize()
+		encrypted := append(plain, bytes.Repeat([]byte{byte(padding)}, padding)...)
+		cipher.NewCBCEncrypter(block, pkcs12KDF(password, salt, 2, pkcs12Iterations, 8)).
+			CryptBlocks(encrypted, encrypted)
+		der, err := asn1.Marshal(encryptedPrivateKeyInfo{
+			Algorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  oidPBEWithSHAAnd3DESCBC,
+				Parameters: asn1.RawValue{FullBytes: params},
+			},
+			EncryptedData: encrypted,
+		})
+		if err != nil {
+			return nil, err
+		}
+		attributes, err := ks.keyAttributes()
+		if err != nil {
+			return nil, err
+		}
+		keyBags = append(keyBags, pkcs12SafeBag{
+			ID:         oidShroudedKeyBag,
+			Value:      explicit(der),
+			Attributes: attributes,
+		})
+	}
+
+	var authSafe []pkcs12ContentInfo
+	for _, bags := range [][]pkcs12SafeBag{certBags, keyBags} {
+		if len(bags) == 0 {
+			continue
+		}
+		content, err := dataContentInfo(bags)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, content)
+	}
+	authSafeDER, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	octets, err := asn1.Marshal(authSafeDER)
+	if err != nil {
+		return nil, err
+	}
+
+	var macData pkcs12MacData
+	macData.Salt = derivedSalt("pkcs12 mac", authSafeDER)
+	macData.Iterations = pkcs12Iterations
+	mac := hmac.New(sha1.New, pkcs12KDF(password, macData.Salt, 3, pkcs12Iterations, 20))
+	mac.Write(authSafeDER)
+	macData.Mac.Algorithm = pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue}
+	macData.Mac.Digest = mac.Sum(nil)
+
+	return asn1.Marshal(struct {
+		Version  int
+		AuthSafe pkcs12ContentInfo
+		MacData  pkcs12MacData
+	}{
+		Version:  3,
+		AuthSafe: pkcs12ContentInfo{ContentType: oidData, Content: explicit(octets)},
+		MacData:  macData,
+	})
+}
+
+// keyAttributes returns the attributes pairing the private key with its
+// certificate.
+func (ks javaKeystore) keyAttributes() ([]pkcs12Attribute, error) {
+	sum := sha1.Sum(ks.Certificates[0].Raw)
+	id, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return []pkcs12Attribute{
+		friendlyName(ks.Alias),
+		{ID: oidLocalKeyID, Value: set(id)},
+	}, nil
+}
+
+func friendlyName(name string) pkcs12Attribute {
+	value := bmpString(name)
+	value = value[:len(value)-2]
+	der, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: value})
+	return pkcs12Attribute{ID: oidFriendlyName, Value: set(der)}
+}
+
+// dataContentInfo returns an unencrypted ContentInfo holding bags.
+func dataContentInfo(bags []pkcs12SafeBag) (pkcs12ContentInfo, error) {
+	der, err := asn1.Marshal(bags)
+	if err != nil {
+		return pkcs12ContentInfo{}, err
+	}
+	octets, err := asn1.Marshal(der)
+	if err != nil {
+		return pkcs12ContentInfo{}, err
+	}
+	return pkcs12ContentInfo{ContentType: oidData, Content: explicit(octets)}, nil
+}
+
+// bmpString encodes s as a null terminated BMPString, as PKCS#12 passwords.
+func bmpString(s string) []byte {
+	var encoded []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		encoded = append(encoded, byte(r>>8), byte(r))
+	}
+	return append(encoded, 0, 0)
+}
+
+// pkcs12KDF derives size bytes from password and salt with SHA-1, following
+// RFC 7292 appendix B.2, id being 1 for keys, 2 for IVs and 3 for MAC keys.
+func pkcs12KDF(password, salt []byte, id byte, iterations, size int) []byte {
+	const u, v = sha1.Size, 64
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		filled := make([]byte, v*((len(b)+v-1)/v))
+		for i := range filled {
+			filled[i] = b[i%len(b)]
+		}
+		return filled
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+	var derived []byte
+	for len(derived) < size {
+		h := sha1.New()
+		h.Write(d)
+		h.Write(i)
+		a := h.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			sum := sha1.Sum(a)
+			a = sum[:]
+		}
+		derived = append(derived, a...)
+
+		b := new(big.Int).SetBytes(fill(a)[:v])
+		b.Add(b, big.NewInt(1))
+		for j := 0; j < len(i); j += v {
+			block := new(big.Int).SetBytes(i[j : j+v])
+			sum := block.Add(block, b).Bytes()
+			if len(sum) > v {
+				sum = sum[len(sum)-v:]
+			}
+			chunk := i[j : j+v]
+			for k := range chunk {
+				chunk[k] = 0
+			}
+			copy(chunk[v-len(sum):], sum)
+		}
+	}
+	return derived[:size]
+}
+
+// jks encodes the keystore in the Java KeyStore format, the private key
+// being protected by the JKS key protector.
+func (ks javaKeystore) jks() ([]byte, error) {
+	password := bmpString(ks.Password)
+	password = password[:len(password)-2]
+	timestamp := ks.Certificates[0].NotBefore.UnixNano() / int64(time.Millisecond)
+
+	var buf bytes.Buffer
+	write := func(values ...interface{}) {
+		for _, value := range values {
+			binary.Write(&buf, binary.BigEndian, value)
+		}
+	}
+	writeUTF := func(s string) {
+		write(uint16(len(s)))
+		buf.WriteString(s)
+	}
+	writeCert := func(cert *x509.Certificate) {
+		writeUTF("X.509")
+		write(uint32(len(cert.Raw)))
+		buf.Write(cert.Raw)
+	}
+
+	write(uint32(0xFEEDFEED), uint32(2))
+	if ks.PrivateKey == nil {
+		write(uint32(len(ks.Certificates)))
+		for i, cert := range ks.Certificates {
+			write(uint32(2))
+			writeUTF(strings.ToLower(truststoreAlias(ks.Alias, i, len(ks.Certificates))))
+			write(timestamp)
+			writeCert(cert)
+		}
+	} else {
+		plain, err := x509.MarshalPKCS8PrivateKey(ks.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		// The key protector XORs the key with a SHA-1 based key stream,
+		// and appends the digest of the password and the key.
+		salt := derivedSalt("jks key", ks.Certificates[0].Raw)
+		protected := append([]byte{}, salt...)
+		digest := salt
+		for i := 0; i < len(plain); i += sha1.Size {
+			sum := sha1.Sum(append(append([]byte{}, password...), digest...))
+			digest = sum[:]
+			for j := 0; j < sha1.Size && i+j < len(plain); j++ {
+				protected = append(protected, plain[i+j]^digest[j])
+			}
+		}
+		check := sha1.Sum(append(append([]byte{}, password...), plain...))
+		protected = append(protected, check[:]...)
+		der, err := asn1.Marshal(encryptedPrivateKeyInfo{
+			Algorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  oidJKSKeyProtector,
+				Parameters: asn1.NullRawValue,
+			},
+			EncryptedData: protected,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		write(uint32(1), uint32(1))
+		writeUTF(strings.ToLower(ks.Alias))
+		write(timestamp, uint32(len(der)))
+		buf.Write(der)
+		write(uint32(len(ks.Certificates)))
+		for _, cert := range ks.Certificates {
+			writeCert(cert)
+		}
+	}
+
+	h := sha1.New()
+	h.Write(password)
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+	return buf.Bytes(), nil
+}
+
+// truststoreAlias returns the alias of the i-th of n trusted certificates.
+func truststoreAlias(alias string, i, n int) string {
+	if n == 1 {
+		return alias
+	}
+	return fmt.Sprintf("%s-%d", alias, i)
+}
+
+// derivedSalt returns a salt derived from public content, keeping the
+// encoding deterministic. The salt is stored in clear, so it must never be
+// derived from the password or the key, or it would let anyone check a
+// guessed password without the key derivation.
+func derivedSalt(purpose string, parts ...[]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(purpose))
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)[:20]
+}
+
+// keyValuesFromStructuredFile reads the top-level values of a YAML, JSON or
+// INI file, or the ones of its selected section, in the order of the file.
+// Nested values are flattened.
+func (kvl *kvLoader) keyValuesFromStructuredFile(location string, format formats.Format) ([]types.Pair, error) {
+	content, err := kvl.ldr.Load(location)
+	if err != nil {
+		return nil, err
+	}
+	branches, err := common.StoreForFormat(format).LoadPlainFile(content)
+	if err != nil {
+		return nil, err
+	}
+	if len(branches) == 0 {
+		return nil, nil
+	}
+	branch := branches[0]
+	section := kvl.sources[location].Section
+	if section == "" && format == formats.Ini {
+		section = "DEFAULT"
+	}
+	if section != "" {
+		var found bool
+		for _, item := range branch {
+			if _, ok := item.Key.(sops.Comment); !ok && fmt.Sprint(item.Key) == section {
+				branch, found = item.Value.(sops.TreeBranch)
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no section %q", section)
+		}
+	}
+
+	var pairs []types.Pair
+	for _, item := range branch {
+		if _, ok := item.Key.(sops.Comment); ok {
+			continue
+		}
+		if pairs, err = kvl.flatten.flatten(pairs, fmt.Sprint(item.Key), item.Value); err != nil {
+			return nil, err
+		}
+	}
+	return pairs, nil
+}
+
+// scalarString formats a scalar value of a YAML, JSON or INI file.
+func scalarString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool, int, int64, uint64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("unsupported value of type %T", value)
+	}
+}
+
+// dockerConfigJSON builds the .dockerconfigjson of the credentials read
+// from the registries sources.
+func (kvl *kvLoader) dockerConfigJSON() (string, error) {
+	type auth struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Email    string `json:"email,omitempty"`
+		Auth     string `json:"auth"`
+	}
+	auths := map[string]auth{}
+	sources := map[string]string{}
+	for _, source := range kvl.registries {
+		content, err := kvl.ldr.Load(source)
+		if err != nil {
+			return "", fmt.Errorf("registry source %q: %v", source, err)
+		}
+		var document struct {
+			Registries []RegistryCredentials `json:"registries"`
+		}
+		if err := yaml.Unmarshal(content, &document); err != nil {
+			return "", fmt.Errorf("registry source %q: %v", source, err)
+		}
+		for i, c := range document.Registries {
+			missing := ""
+			switch {
+			case c.Registry == "":
+				missing = "registry"
+			case c.Username == "":
+				missing = "username"
+			case c.Password == "":
+				missing = "password"
+			}
+			if missing != "" {
+				return "", fmt.Errorf("registry source %q: registries[%d] has no %s",
+					source, i, missing)
+			}
+			if other, exists := sources[c.Registry]; exists {
+				return "", fmt.Errorf("registry %q from %q is already defined by %q",
+					c.Registry, source, other)
+			}
+			sources[c.Registry] = source
+			auths[c.Registry] = auth{
+				Username: c.Username,
+				Password: c.Password,
+				Email:    c.Email,
+				Auth:     base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password)),
+			}
+		}
+	}
+	config, err := json.Marshal(map[string]interface{}{"auths": auths})
+	if err != nil {
+		return "", err
+	}
+	return string(config), nil
+}
+
+// expandGlobs replaces the envs and files sources holding glob patterns
+// with the files they match, which kv.Loader only accepts literally.
+func (kvl *kvLoader) expandGlobs(sources types.KvPairSources) (types.KvPairSources, error) {
+	var envs []string
+	for _, s := range sources.EnvSources {
+		if isRemote(s) || !isGlob(s) {
+			envs = append(envs, s)
+			continue
+		}
+		matches, err := kvl.glob(s)
+		if err != nil {
+			return sources, err
+		}
+		envs = append(envs, matches...)
+	}
+
+	var files []string
+	for _, s := range sources.FileSources {
+		key, pattern := "", s
+		if parts := strings.SplitN(s, "=", 2); len(parts) == 2 {
+			key, pattern = parts[0], parts[1]
+		}
+		if _, location := parseRemoteFileSource(s); isRemote(location) || !isGlob(pattern) {
+			files = append(files, s)
+			continue
+		}
+		matches, err := kvl.glob(pattern)
+		if err != nil {
+			return sources, err
+		}
+		if key != "" {
+			if len(matches) > 1 {
+				return sources, fmt.Errorf(
+					"file source %q: key %q given for %d files", s, key, len(matches))
+			}
+			matches[0] = key + "=" + matches[0]
+		}
+		files = append(files, matches...)
+	}
+
+	sources.EnvSources = envs
+	sources.FileSources = files
+	return sources, nil
+}
+
+// glob returns the files, relative to the loader root, matching pattern
+// on disk, in lexical order. No match is an error.
+func (kvl *kvLoader) glob(pattern string) ([]string, error) {
+	root := kvl.ldr.Root()
+	paths, err := kvl.fSys.Glob(filepath.Join(root, pattern))
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, p := range paths {
+		if kvl.fSys.IsDir(p) {
+			continue
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, rel)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no files match %q", pattern)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// keyValuesFromDirectory walks dir on disk, below the loader root, and
+// loads every matching file through the loader.
+func (kvl *kvLoader) keyValuesFromDirectory(dir DirectorySource) ([]pair, error) {
+	separator := dir.Separator
+	if separator == "" {
+		separator = "_"
+	}
+	root := filepath.Join(kvl.ldr.Root(), dir.Path)
+	var kvs []pair
+	err := kvl.fSys.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !dir.matches(rel) {
+			return nil
+		}
+		location := filepath.Join(dir.Path, rel)
+		content, err := kvl.ldr.Load(location)
+		if err != nil {
+			return err
+		}
+		kvs = append(kvs, pair{types.Pair{
+			Key:   strings.Replace(rel, "/", separator, -1),
+			Value: string(content),
+		}, location})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(kvs) == 0 {
+		return nil, fmt.Errorf("no files found")
+	}
+	return kvs, nil
+}
+
+// matches reports whether the file at the slash separated relative path
+// rel passes the Include and Exclude patterns.
+func (dir DirectorySource) matches(rel string) bool {
+	match := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			name := path.Base(rel)
+			if strings.Contains(pattern, "/") {
+				name = rel
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(dir.Include) == 0 || match(dir.Include)) && !match(dir.Exclude)
+}
+
+// decryption describes a source successfully decrypted by a SopsLoader.
+type decryption struct {
+	Location     string
+	LastModified time.Time
+	Keys         []string
+}
+
+type SopsLoader struct {
+	proxy     ifc.Loader
+	generator string
+	ignoreMac bool
+	auditLog  string
+	decrypted *[]decryption
+	pins      map[string]string
+	checksums map[string]string
+}
+
+func NewSopsLoader(proxy ifc.Loader) *SopsLoader {
+	return &SopsLoader{proxy: proxy}
+}
+
+func (sl *SopsLoader) Root() string {
+	return sl.proxy.Root()
+}
+
+// New returns Loader located at newRoot.
+func (sl *SopsLoader) New(newRoot string) (ifc.Loader, error) {
+	p, err := sl.proxy.New(newRoot)
+	if err != nil {
+		return &SopsLoader{}, err
+	}
+	nl := *sl
+	nl.proxy = p
+	return &nl, nil
+}
+
+// Load returns the bytes read from the location or an error.
+func (sl *SopsLoader) Load(location string) ([]byte, error) {
+	var bytes []byte
+	var err error
+	if isRemote(location) {
+		bytes, err = sl.fetch(location)
+	} else {
+		bytes, err = sl.proxy.Load(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	plain, d, err := sl.decrypt(location, bytes)
+	if auditErr := sl.audit(location, d.Keys, err); auditErr != nil {
+		return nil, auditErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if checksum, ok := sl.checksums[location]; ok {
+		if digest := sha256Hex(plain); digest != checksum {
+			return nil, fmt.Errorf("generator %q: %q decrypts to sha256 %s, expected %s",
+				sl.generator, location, digest, checksum)
+		}
+	}
+	if sl.decrypted != nil {
+		*sl.decrypted = append(*sl.decrypted, d)
+	}
+	return plain, nil
+}
+
+// audit appends an AuditEvent for location to the audit log, if any.
+func (sl *SopsLoader) audit(location string, keys []string, decryptErr error) error {
+	if sl.auditLog == "" {
+		return nil
+	}
+	abs := location
+	if !isRemote(abs) && !filepath.IsAbs(abs) {
+		abs = filepath.Join(sl.Root(), abs)
+	}
+	event := AuditEvent{
+		Time:      time.Now().UTC(),
+		Generator: sl.generator,
+		Path:      abs,
+		Format:    formatNames[formats.FormatForPath(sourceFile(location))],
+		Keys:      keys,
+	}
+	if de, ok := decryptErr.(*DecryptError); ok {
+		event.Failure = de.Reason
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(sl.auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log: %v", err)
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write audit log: %v", err)
+	}
+	return nil
+}
+
+// decrypt follows decrypt.DataWithFormat, but reports each failure as a
+// DecryptError and tolerates a MAC mismatch when ignoreMac is set. It also
+// describes the decryption, including the master keys that were used.
+func (sl *SopsLoader) decrypt(location string, data []byte) ([]byte, decryption, error) {
+	format := formats.FormatForPath(sourceFile(location))
+	d := decryption{Location: location}
+	fail := func(reason DecryptFailure, err error) error {
+		return &DecryptError{
+			Generator: sl.generator,
+			Path:      location,
+			Format:    formatNames[format],
+			Reason:    reason,
+			Err:       err,
+		}
+	}
+
+	store := common.StoreForFormat(format)
+	tree, err := store.LoadEncryptedFile(data)
+	if err != nil {
+		return nil, d, fail(UnsupportedFormat, err)
+	}
+	d.LastModified = tree.Metadata.LastModified
+	key, keys, err := dataKey(tree.Metadata)
+	if err != nil {
+		return nil, d, fail(NoMatchingKey, err)
+	}
+	d.Keys = keys
+
+	cipher := aes.NewCipher()
+	mac, err := tree.Decrypt(key, cipher)
+	if err != nil {
+		return nil, d, fail(CorruptCiphertext, err)
+	}
+	originalMac, err := cipher.Decrypt(
+		tree.Metadata.MessageAuthenticationCode,
+		key,
+		tree.Metadata.LastModified.Format(time.RFC3339),
+	)
+	if err == nil && originalMac != mac {
+		err = fmt.Errorf("expected mac %q, got %q", originalMac, mac)
+	}
+	if err != nil {
+		if !sl.ignoreMac {
+			return nil, d, fail(MacMismatch, err)
+		}
+		log.Printf("warning: generator %q: ignoring MAC mismatch in %q: %v",
+			sl.generator, location, err)
+	}
+
+	plain, err := emitPlainFile(format, store, tree.Branches)
+	if err != nil {
+		return nil, d, fail(UnsupportedFormat, err)
+	}
+	return plain, d, nil
+}
+
+// emitPlainFile serializes decrypted YAML and JSON documents canonically,
+// rather than as the SOPS store does, which depends on its version and may
+// even order keys randomly. Map keys are sorted and comments dropped. JSON
+// is indented with tabs, and documents of a YAML stream are separated by
+// "---". Other formats are left to the store.
+func emitPlainFile(format formats.Format, store common.Store, branches sops.TreeBranches) ([]byte, error) {
+	switch format {
+	case formats.Json:
+		if len(branches) == 0 {
+			return nil, fmt.Errorf("no JSON document")
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(canonicalValue(branches[0])); err != nil {
+			return nil, err
+		}
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+	case formats.Yaml:
+		var out []byte
+		for i, branch := range branches {
+			if i > 0 {
+				out = append(out, "---\n"...)
+			}
+			doc, err := goyaml.Marshal(canonicalValue(branch))
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, doc...)
+		}
+		return out, nil
+	default:
+		return store.EmitPlainFile(branches)
+	}
+}
+
+// canonicalValue converts a SOPS tree value to plain maps, which both the
+// JSON and YAML encoders emit with sorted keys, and slices.
+func canonicalValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case sops.TreeBranch:
+		m := map[string]interface{}{}
+		for _, item := range v {
+			if _, ok := item.Key.(sops.Comment); ok {
+				continue
+			}
+			m[fmt.Sprint(item.Key)] = canonicalValue(item.Value)
+		}
+		return m
+	case []interface{}:
+		elements := []interface{}{}
+		for _, element := range v {
+			if _, ok := element.(sops.Comment); ok {
+				continue
+			}
+			elements = append(elements, canonicalValue(element))
+		}
+		return elements
+	default:
+		return v
+	}
+}
+
+// dataKey recovers the data key like sops.Metadata.GetDataKey, and also
+// returns the master keys that decrypted it.
+func dataKey(metadata sops.Metadata) ([]byte, []string, error) {
+	svc := keyservice.NewLocalClient()
+	var parts [][]byte
+	var used []string
+	var errs []string
+	for _, group := range metadata.KeyGroups {
+		for _, key := range group {
+			svcKey := keyservice.KeyFromMasterKey(key)
+			rsp, err := svc.Decrypt(context.Background(), &keyservice.DecryptRequest{
+				Key:        &svcKey,
+				Ciphertext: key.EncryptedDataKey(),
+			})
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", key.ToString(), err))
+				continue
+			}
+			parts = append(parts, rsp.Plaintext)
+			used = append(used, key.ToString())
+			break
+		}
+	}
+
+	switch {
+	case len(metadata.KeyGroups) == 1 && len(parts) == 1:
+		return parts[0], used, nil
+	case len(metadata.KeyGroups) > 1 && len(parts) >= metadata.ShamirThreshold:
+		key, err := shamir.Combine(parts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not get data key from shamir parts: %v", err)
+		}
+		return key, used, nil
+	}
+	return nil, nil, fmt.Errorf("no master key could decrypt the data key: %s",
+		strings.Join(errs, "; "))
+}
+
+// fetch returns the content of a remote source, which must be pinned. The
+// content is cached on disk under its digest and only downloaded when the
+// cache misses.
+func (sl *SopsLoader) fetch(location string) ([]byte, error) {
+	pin, ok := sl.pins[location]
+	if !ok {
+		return nil, fmt.Errorf("remote source %q has no sha256 in sources", location)
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	cached := filepath.Join(dir, pin)
+	if content, err := ioutil.ReadFile(cached); err == nil && sha256Hex(content) == pin {
+		return content, nil
+	}
+
+	var content []byte
+	if strings.HasPrefix(location, "git::") {
+		content, err = fetchGit(location)
+	} else {
+		content, err = fetchHTTP(location)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch %q: %v", location, err)
+	}
+	if digest := sha256Hex(content); digest != pin {
+		return nil, fmt.Errorf("remote source %q has sha256 %s, expected %s",
+			location, digest, pin)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(cached, content, 0600); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// cacheDir returns the directory remote sources are cached in.
+func cacheDir() (string, error) {
+	if dir := os.Getenv(CacheDirEnv); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "kustomize-sealed-secrets"), nil
+}
+
+func fetchHTTP(location string) ([]byte, error) {
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// fetchGit reads a single file of a remote git repository, with a shallow
+// fetch of the requested ref into a throwaway repository.
+func fetchGit(location string) ([]byte, error) {
+	repo, file, ref, err := parseGitSource(location)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "kustomize-sealed-secrets-git")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) ([]byte, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("git %s: %v: %s",
+				args[0], err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return out, err
+	}
+	if _, err := git("init", "--quiet"); err != nil {
+		return nil, err
+	}
+	if _, err := git("fetch", "--quiet", "--depth", "1", "--", repo, ref); err != nil {
+		return nil, err
+	}
+	return git("show", "FETCH_HEAD:"+file)
+}
+
+// parseGitSource splits git::<repository>//<file>[?ref=<ref>] into its
+// parts, the ref defaulting to HEAD. The repository and ref may not start
+// with "-", which git would read as an option.
+func parseGitSource(location string) (repo, file, ref string, err error) {
+	source := strings.TrimPrefix(location, "git::")
+	ref = "HEAD"
+	if i := strings.Index(source, "?"); i >= 0 {
+		query, err := url.ParseQuery(source[i+1:])
+		if err != nil {
+			return "", "", "", err
+		}
+		if query.Get("ref") != "" {
+			ref = query.Get("ref")
+		}
+		source = source[:i]
+	}
+	start := 0
+	if i := strings.Index(source, "://"); i >= 0 {
+		start = i + len("://")
+	}
+	i := strings.Index(source[start:], "//")
+	if i < 0 {
+		return "", "", "", fmt.Errorf("no file path in git source %q", location)
+	}
+	repo, file = source[:start+i], source[start+i+2:]
+	if strings.HasPrefix(repo, "-") || strings.HasPrefix(ref, "-") {
+		return "", "", "", fmt.Errorf("git source %q: the repository and ref may not start with \"-\"", location)
+	}
+	return repo, file, ref, nil
+}
+
+// parseRemoteFileSource splits a [{key}=]{location} file source, where
+// location may itself contain "=" in its query.
+func parseRemoteFileSource(source string) (key, location string) {
+	location = source
+	if i := strings.Index(source, "="); i >= 0 && !strings.ContainsAny(source[:i], ":/") {
+		key, location = source[:i], source[i+1:]
+	}
+	if key == "" {
+		key = path.Base(sourceFile(location))
+	}
+	return key, location
+}
+
+func isRemote(location string) bool {
+	return strings.HasPrefix(location, "git::") ||
+		strings.HasPrefix(location, "https://") ||
+		strings.HasPrefix(location, "http://")
+}
+
+// sourceFile returns the path of the file a location points to, stripping
+// the repository and query of remote sources.
+func sourceFile(location string) string {
+	if !isRemote(location) {
+		return location
+	}
+	if strings.HasPrefix(location, "git::") {
+		if _, file, _, err := parseGitSource(location); err == nil {
+			return file
+		}
+	}
+	if u, err := url.Parse(location); err == nil {
+		return u.Path
+	}
+	return location
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
 }
 
 // Cleanup cleans the loader
@@ -1,21 +1,69 @@
 package main_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
-	"go.mozilla.org/sops/v3"
-	"go.mozilla.org/sops/v3/aes"
-	"go.mozilla.org/sops/v3/cmd/sops/codes"
-	"go.mozilla.org/sops/v3/cmd/sops/common"
-	"go.mozilla.org/sops/v3/cmd/sops/formats"
-	"go.mozilla.org/sops/v3/config"
-	"go.mozilla.org/sops/v3/keyservice"
-	"go.mozilla.org/sops/v3/version"
+	"golang.org/x/crypto/pkcs12"
+	"golang.org/x/crypto/ssh"
 
+	"github.com/jbrixhe/kustomize-sealed-secrets/sealedtest"
+	"github.com/klauspost/compress/zstd"
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/resmap"
 	kusttest_test "sigs.k8s.io/kustomize/api/testutils/kusttest"
 )
 
+// testKey is the throwaway PGP key the fixtures are encrypted for, so that
+// the tests need neither gpg nor a preconfigured keyring.
+var testKey *sealedtest.PGPKey
+
+func TestMain(m *testing.M) {
+	keyring, err := sealedtest.NewKeyring()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	testKey, err = keyring.Generate("kustomize-sealed-secrets tests")
+	if err != nil {
+		keyring.Close()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	if err := keyring.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(code)
+}
+
 func TestSealedSecretGenerator(t *testing.T) {
 	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
 		"sealed.secrets", "v1", "SealedSecretGenerator")
@@ -300,6 +348,8 @@ files:
 - tls.crt
 - tls.key
 type: "Sealed/tls"
+tls:
+  onExpiry: warn
 `)
 
 	th.AssertActualEqualsExpected(rm, `
@@ -315,62 +365,2445 @@ type: kubernetes.io/tls
 `)
 }
 
-func writeAndEncrypt(th *kusttest_test.HarnessEnhanced, path, content string) {
-	encryptedContent, err := encrypt(path, content)
-	if err != nil {
-		th.GetT().Fatal(err)
-		return
+func TestSealedMacMismatch(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "/app/a.env", `
+ROUTER_PASSWORD=admin
+`)
+	tamper(th, "/app/a.env")
+
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+envs:
+- a.env
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(),
+		`generator "mySecret": unable to decrypt "a.env" as dotenv: MAC mismatch`) {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	th.WriteF(path, string(encryptedContent))
 }
 
-func encrypt(path, content string) ([]byte, error) {
-	format := formats.FormatForPath(path)
-	store := common.StoreForFormat(format)
+func TestSealedIgnoreMac(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "a.env", `
+ROUTER_PASSWORD=admin
+`)
+	tamper(th, "a.env")
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Sealed
+ignoreMac: true
+envs:
+- a.env
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  ROUTER_PASSWORD: YWRtaW4=
+kind: Secret
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Opaque
+`)
+}
+
+func TestSealedAuditLog(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
 
-	branches, err := store.LoadPlainFile([]byte(content))
+	dir, err := ioutil.TempDir("", "audit")
 	if err != nil {
-		return nil, common.NewExitError(fmt.Sprintf("Error unmarshalling file: %s", err), codes.CouldNotReadInputFile)
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
+	auditLog := filepath.Join(dir, "audit.log")
+
+	writeAndEncrypt(th, "a.env", `
+ROUTER_PASSWORD=admin
+`)
+	writeAndEncrypt(th, "longsecret", `iloveyou`)
+
+	th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+auditLog: ` + auditLog + `
+envs:
+- a.env
+files:
+- longsecret
+`)
 
-	configPath, err := config.FindConfigFile(".")
+	content, err := ioutil.ReadFile(auditLog)
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "admin") ||
+		strings.Contains(string(content), "iloveyou") {
+		t.Fatalf("audit log leaks plaintext: %s", content)
 	}
 
-	conf, err := config.LoadForFile(configPath, path, make(map[string]*string))
-	if err != nil {
-		return nil, err
+	var paths []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var event struct {
+			Generator string
+			Path      string
+			Keys      []string
+		}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Generator != "mySecret" {
+			t.Errorf("unexpected generator %q", event.Generator)
+		}
+		if len(event.Keys) != 1 || event.Keys[0] != testKey.Fingerprint {
+			t.Errorf("unexpected keys %v", event.Keys)
+		}
+		paths = append(paths, event.Path)
+	}
+	if fmt.Sprint(paths) != "[/a.env /longsecret]" {
+		t.Fatalf("unexpected audited paths %v", paths)
+	}
+}
+
+func TestSealedExpiredSource(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "/app/a.env", `
+ROUTER_PASSWORD=admin
+`)
+
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+envs:
+- a.env
+sources:
+- path: a.env
+  expiresAt: 2020-04-01
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(),
+		`generator "mySecret": source "a.env" expired at 2020-04-01T00:00:00Z`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSealedMaxAgeWarning(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "a.env", `
+ROUTER_PASSWORD=admin
+`)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Sealed
+envs:
+- a.env
+sources:
+- path: a.env
+  maxAge: 1ns
+  onExpiry: warn
+`)
+
+	if !regexp.MustCompile(`warning: generator "mySecret": source "a.env" last modified at \S+, more than 1ns ago`).
+		MatchString(logs.String()) {
+		t.Fatalf("unexpected logs %q", logs.String())
 	}
 
-	tree := sops.Tree{
-		Branches: branches,
-		Metadata: sops.Metadata{
-			KeyGroups:       conf.KeyGroups,
-			Version:         version.Version,
-			ShamirThreshold: conf.ShamirThreshold,
-		},
-		FilePath: path,
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  ROUTER_PASSWORD: YWRtaW4=
+kind: Secret
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Opaque
+`)
+}
+
+func TestSealedDirectorySource(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	disk, dir := makeDiskHarness(t, "secrets/db", "secrets/router")
+	defer os.RemoveAll(dir)
+
+	writeAndEncrypt(disk, filepath.Join(dir, "secrets/db/password"), `iloveyou`)
+	writeAndEncrypt(disk, filepath.Join(dir, "secrets/router/password"), `admin`)
+	writeAndEncrypt(disk, filepath.Join(dir, "secrets/router/password.bak"), `admin0`)
+
+	disk.WriteK(dir, `
+generators:
+- generator.yaml
+`)
+	disk.WriteF(filepath.Join(dir, "generator.yaml"), `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Sealed
+disableNameSuffixHash: true
+directories:
+- path: secrets
+  exclude:
+  - "*.bak"
+  separator: .
+`)
+
+	rm := disk.Run(dir, disk.MakeOptionsPluginsEnabled())
+	disk.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  db.password: aWxvdmV5b3U=
+  router.password: YWRtaW4=
+kind: Secret
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Opaque
+`)
+}
+
+func TestSealedGlobSources(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	disk, dir := makeDiskHarness(t, "secrets", "certs")
+	defer os.RemoveAll(dir)
+
+	writeAndEncrypt(disk, filepath.Join(dir, "secrets/b.enc.env"), `
+DB_PASSWORD=iloveyou
+`)
+	writeAndEncrypt(disk, filepath.Join(dir, "secrets/a.enc.env"), `
+ROUTER_PASSWORD=admin
+`)
+	writeAndEncrypt(disk, filepath.Join(dir, "certs/ca.pem"), `ca`)
+	writeAndEncrypt(disk, filepath.Join(dir, "certs/server.pem"), `server`)
+
+	disk.WriteK(dir, `
+generators:
+- generator.yaml
+`)
+	disk.WriteF(filepath.Join(dir, "generator.yaml"), `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Sealed
+disableNameSuffixHash: true
+envs:
+- secrets/*.enc.env
+files:
+- certs/*.pem
+`)
+
+	rm := disk.Run(dir, disk.MakeOptionsPluginsEnabled())
+	disk.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  DB_PASSWORD: aWxvdmV5b3U=
+  ROUTER_PASSWORD: YWRtaW4=
+  ca.pem: Y2E=
+  server.pem: c2VydmVy
+kind: Secret
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Opaque
+`)
+}
+
+func TestSealedGlobWithoutMatch(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	disk, dir := makeDiskHarness(t)
+	defer os.RemoveAll(dir)
+
+	disk.WriteK(dir, `
+generators:
+- generator.yaml
+`)
+	disk.WriteF(filepath.Join(dir, "generator.yaml"), `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+files:
+- certs/*.pem
+`)
+
+	err := disk.RunWithErr(dir, disk.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), `no files match "certs/*.pem"`) {
+		t.Fatalf("unexpected error: %v", err)
 	}
+}
 
-	dataKey, errs := tree.GenerateDataKeyWithKeyServices([]keyservice.KeyServiceClient{keyservice.NewLocalClient()})
-	if len(errs) > 0 {
-		return nil, fmt.Errorf("Could not generate data key: %s", errs)
+// makeDiskHarness returns a harness backed by a new temporary directory on
+// disk, for the sources the plugin must list rather than just load.
+func makeDiskHarness(t *testing.T, dirs ...string) (kusttest_test.Harness, string) {
+	dir, err := ioutil.TempDir("", "kustomize-sealed-secrets")
+	if err != nil {
+		t.Fatal(err)
 	}
+	for _, d := range dirs {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kusttest_test.MakeHarnessWithFs(t, filesys.MakeFsOnDisk()), dir
+}
 
-	err = common.EncryptTree(common.EncryptTreeOpts{
-		DataKey: dataKey,
-		Tree:    &tree,
-		Cipher:  aes.NewCipher(),
-	})
+func TestSealedRemoteSources(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	dir, err := ioutil.TempDir("", "remote")
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("SEALED_SECRETS_CACHE_DIR", filepath.Join(dir, "cache"))
+	defer os.Unsetenv("SEALED_SECRETS_CACHE_DIR")
+
+	env := encryptOrDie(t, "a.env", `
+ROUTER_PASSWORD=admin
+`)
+	repo := makeGitRepo(t, dir, map[string][]byte{"secrets/a.env": env})
+
+	pem := encryptOrDie(t, "server.pem", `server`)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/certs/server.pem" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(pem)
+		}))
+	defer server.Close()
+
+	gitSource := "git::file://" + repo + "//secrets/a.env?ref=v1.2"
+	httpSource := server.URL + "/certs/server.pem"
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Sealed
+envs:
+- ` + gitSource + `
+files:
+- cert=` + httpSource + `
+sources:
+- path: ` + gitSource + `
+  sha256: ` + sha256Hex(env) + `
+- path: ` + httpSource + `
+  sha256: ` + sha256Hex(pem) + `
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  ROUTER_PASSWORD: YWRtaW4=
+  cert: c2VydmVy
+kind: Secret
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Opaque
+`)
+
+	if _, err := os.Stat(filepath.Join(dir, "cache", sha256Hex(pem))); err != nil {
+		t.Fatalf("remote source not cached: %v", err)
 	}
+}
+
+func TestSealedRemoteSourceMismatch(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
 
-	encryptedFile, err := store.EmitEncryptedFile(tree)
+	dir, err := ioutil.TempDir("", "remote")
 	if err != nil {
-		return nil, common.NewExitError(fmt.Sprintf("Could not marshal tree: %s", err), codes.ErrorDumpingTree)
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
+	os.Setenv("SEALED_SECRETS_CACHE_DIR", dir)
+	defer os.Unsetenv("SEALED_SECRETS_CACHE_DIR")
+
+	env := encryptOrDie(t, "a.env", "ROUTER_PASSWORD=admin")
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write(env)
+		}))
+	defer server.Close()
 
-	return encryptedFile, nil
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+envs:
+- `+server.URL+`/a.env
+sources:
+- path: `+server.URL+`/a.env
+  sha256: `+sha256Hex([]byte("something else"))+`
+`)
+
+	err = th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "expected "+sha256Hex([]byte("something else"))) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSealedGitSourceOption(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("SEALED_SECRETS_CACHE_DIR", filepath.Join(dir, "cache"))
+	defer os.Unsetenv("SEALED_SECRETS_CACHE_DIR")
+
+	pwned := filepath.Join(dir, "pwned")
+	for _, source := range []string{
+		"git::--upload-pack=touch " + pwned + "//a.env",
+		"git::file://" + dir + "//a.env?ref=--upload-pack=touch " + pwned,
+	} {
+		th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+		th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+envs:
+- "`+source+`"
+sources:
+- path: "`+source+`"
+  sha256: `+sha256Hex([]byte("ROUTER_PASSWORD=admin"))+`
+`)
+
+		err = th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if !strings.Contains(err.Error(), `the repository and ref may not start with "-"`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(pwned); !os.IsNotExist(err) {
+			t.Fatalf("git ran the upload pack: %v", err)
+		}
+	}
+}
+
+// makeGitRepo commits files to a new bare repository below dir, tagged
+// v1.2, and returns its path.
+func makeGitRepo(t *testing.T, dir string, files map[string][]byte) string {
+	work := filepath.Join(dir, "work")
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(work, name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(work, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := filepath.Join(dir, "repo.git")
+	for _, args := range [][]string{
+		{"-C", work, "init", "--quiet"},
+		{"-C", work, "add", "."},
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@example.com",
+			"commit", "--quiet", "-m", "secrets"},
+		{"-C", work, "tag", "v1.2"},
+		{"clone", "--quiet", "--bare", work, repo},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	return repo
+}
+
+func encryptOrDie(t *testing.T, path, content string) []byte {
+	encryptedContent, err := encrypt(path, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encryptedContent
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSealedOverlayMerge(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "base/secrets.enc.env", `
+DB_HOST=localhost
+DB_PASSWORD=iloveyou
+ROUTER_PASSWORD=admin
+`)
+	writeAndEncrypt(th, "overlays/prod/secrets.enc.env", `
+DB_HOST=db.prod
+DB_PASSWORD=s3cr3t
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Sealed
+envs:
+- base/secrets.enc.env
+- overlays/prod/secrets.enc.env
+literals:
+- DB_HOST=db.local
+merge:
+  behavior: create
+  keys:
+    DB_HOST: replace
+    DB_PASSWORD: replace
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  DB_HOST: ZGIubG9jYWw=
+  DB_PASSWORD: czNjcjN0
+  ROUTER_PASSWORD: YWRtaW4=
+kind: Secret
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Opaque
+`)
+}
+
+func TestSealedOverlayConflict(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "/app/base.env", `
+DB_PASSWORD=iloveyou
+`)
+	writeAndEncrypt(th, "/app/prod.env", `
+DB_PASSWORD=s3cr3t
+`)
+
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+envs:
+- base.env
+- prod.env
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(),
+		`key "DB_PASSWORD" from "prod.env" conflicts with "base.env"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSealedOverlayBehaviorMerge(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeBaseAndOverlay(th, "Merge")
+
+	rm := th.Run("/app/overlay", th.MakeOptionsPluginsEnabled())
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  DB_PASSWORD: czNjcjN0
+  ROUTER_PASSWORD: YWRtaW4=
+kind: Secret
+metadata:
+  annotations: {}
+  labels:
+    app: router
+  name: mySecret-b59t6kg64h
+  namespace: whatever
+type: Opaque
+`)
+}
+
+func TestSealedOverlayBehaviorReplace(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeBaseAndOverlay(th, "replace")
+
+	rm := th.Run("/app/overlay", th.MakeOptionsPluginsEnabled())
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  DB_PASSWORD: czNjcjN0
+kind: Secret
+metadata:
+  annotations: {}
+  labels:
+    app: router
+  name: mySecret-87tm2kdt97
+  namespace: whatever
+type: Opaque
+`)
+}
+
+// writeBaseAndOverlay writes a base generating a Secret, and an overlay
+// generating the same Secret with the given behavior.
+func writeBaseAndOverlay(th *kusttest_test.HarnessEnhanced, behavior string) {
+	writeAndEncrypt(th, "/app/base/secrets.enc.env", `
+DB_PASSWORD=iloveyou
+ROUTER_PASSWORD=admin
+`)
+	writeAndEncrypt(th, "/app/overlay/secrets.enc.env", `
+DB_PASSWORD=s3cr3t
+`)
+	th.WriteK("/app/base", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/base/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Sealed
+labels:
+  app: router
+envs:
+- secrets.enc.env
+`)
+	th.WriteK("/app/overlay", `
+resources:
+- ../base
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/overlay/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+  namespace: whatever
+type: Sealed
+behavior: `+behavior+`
+envs:
+- secrets.enc.env
+`)
+}
+
+func TestSealedVars(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	os.Setenv("SEALED_TEST_ENV", "prod")
+	defer os.Unsetenv("SEALED_TEST_ENV")
+
+	writeAndEncrypt(th, "prod/secrets.enc.env", `
+DB_PASSWORD=s3cr3t
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: db-${SEALED_TEST_ENV}
+  namespace: ${APP}-${SEALED_TEST_ENV}
+type: Sealed
+vars:
+  APP: shop
+  SEALED_TEST_ENV: dev
+labels:
+  env: ${SEALED_TEST_ENV}
+annotations:
+  description: costs $5, not $APP or $
+envs:
+- ${SEALED_TEST_ENV}/secrets.enc.env
+literals:
+- PRICE=$5
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  DB_PASSWORD: czNjcjN0
+  PRICE: JDU=
+kind: Secret
+metadata:
+  annotations:
+    description: costs $5, not $APP or $
+  labels:
+    env: prod
+  name: db-prod
+  namespace: shop-prod
+type: Opaque
+`)
+}
+
+func TestSealedProvenance(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "a.env", `
+ROUTER_PASSWORD=admin
+`)
+	writeAndEncrypt(th, "longsecret", `iloveyou`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+provenance: true
+provenancePrefix: example.com/
+annotations:
+  team: platform
+envs:
+- a.env
+files:
+- longsecret
+`)
+
+	annotations := rm.Resources()[0].GetAnnotations()
+	if annotations["team"] != "platform" {
+		t.Errorf("lost annotations %v", annotations)
+	}
+	if annotations["example.com/version"] != "dev" {
+		t.Errorf("unexpected version %q", annotations["example.com/version"])
+	}
+	encoded := annotations["example.com/sources"]
+	if strings.Contains(encoded, "admin") || strings.Contains(encoded, "iloveyou") {
+		t.Fatalf("provenance leaks plaintext: %s", encoded)
+	}
+	var sources []struct {
+		Path         string
+		LastModified time.Time
+		Keys         []string
+	}
+	if err := json.Unmarshal([]byte(encoded), &sources); err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 2 || sources[0].Path != "a.env" || sources[1].Path != "longsecret" {
+		t.Fatalf("unexpected sources %s", encoded)
+	}
+	for _, source := range sources {
+		if time.Since(source.LastModified) > time.Hour {
+			t.Errorf("unexpected lastModified %s", source.LastModified)
+		}
+		if len(source.Keys) != 1 || source.Keys[0] != testKey.Fingerprint {
+			t.Errorf("unexpected keys %v", source.Keys)
+		}
+	}
+}
+
+func TestSealedImmutable(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "/app/a.env", `
+ROUTER_PASSWORD=admin
+`)
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+immutable: true
+envs:
+- a.env
+`)
+
+	rm := th.Run("/app", th.MakeOptionsPluginsEnabled())
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  ROUTER_PASSWORD: YWRtaW4=
+immutable: true
+kind: Secret
+metadata:
+  name: mySecret-42gk75k7dg
+type: Opaque
+`)
+}
+
+func TestSealedImmutableWithoutHash(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "/app/a.env", `
+ROUTER_PASSWORD=admin
+`)
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+immutable: true
+disableNameSuffixHash: true
+envs:
+- a.env
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "immutable Secrets need a name suffix hash") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSealedStringDataOutput(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "a.env", `
+ROUTER_PASSWORD=admin
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+output: stringData
+envs:
+- a.env
+literals:
+- greeting=héllo
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: mySecret
+stringData:
+  ROUTER_PASSWORD: admin
+  greeting: héllo
+type: Opaque
+`)
+}
+
+func TestSealedStringDataKeepsBinary(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	th.WriteF("blob", "\x00\xff\xfe\x01")
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Opaque
+output: stringData
+files:
+- blob
+literals:
+- user=admin
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  blob: AP/+AQ==
+kind: Secret
+metadata:
+  name: mySecret
+stringData:
+  user: admin
+type: Opaque
+`)
+}
+
+func TestSealedStringDataStrict(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+strict: true
+output: stringData
+literals:
+- user=admin
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "output stringData is not allowed in strict mode") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSealedStringDataImmutable(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+immutable: true
+output: stringData
+literals:
+- user=admin
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "immutable Secrets need their values hashed, output stringData cannot be set") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// keystoreP12 is a PKCS#12 keystore holding a P-256 key and its self-signed
+// certificate, protected by the password "changeit".
+const keystoreP12 = `
+MIIDegIBAzCCA0AGCSqGSIb3DQEHAaCCAzEEggMtMIIDKTCCAh8GCSqGSIb3DQEH
+BqCCAhAwggIMAgEAMIICBQYJKoZIhvcNAQcBMBwGCiqGSIb3DQEMAQYwDgQIdsMk
+4IE6n7ECAggAgIIB2Py8PcdLz/MQ/QgjwHvNbYfup4HSBSek9EjgQGQuVIWi/ACB
+FS6B1Z+lowF49CZWnVwtgZeDsCfJk4VWtRD4MmubLL113KogKRJZqKFpSL9PwtVl
+n/t5NU3iDHm85cyZH/xTnc+UqGGtp4bTnCVRJtjP54iVpThi90NMlfewDqYdhWZI
+72WjLfortq1B0ek8/1JOa2gfW7v9Vg2+KvOpUI+xAaXT54B5czm5lom7crZWKh8t
+aZObVnZeEB+ke48Ru3ezZpw8fJO4bLh3ofy18IH/hnBl2B1Q+qsyiqNxV6Uy80nT
+N8u19bYGIzkDcJ5uiPxHedEBUe7BHklecv/jRtSfCAIMvmaHZSFr/PKFAscBSQG9
+bqOW2sIaqNXlgwHnJFU3D2FQ+NCcAL6Fn9B2fgZm3N+eX9OjcUKaC8EzZICDhgS+
+9VNdnD7ZlEzfsiDhrh8wB5ANitot96Pe2teYjHGuDn8VR4SbGKEclPAwFkyt17A3
+m0jrWiB5bid32gSJPbsYMpSZtceBTa9jEmqY31RI6Fcxp1OKPJaWvNn+d/f9K0oH
+Fi5ru1JAlRwvS/gyo6b7igsQLknWaNFwOscfpRAxA6Kx9rvDRup35if+omXzIlLx
+p4TdwIUwggECBgkqhkiG9w0BBwGggfQEgfEwge4wgesGCyqGSIb3DQEMCgECoIG0
+MIGxMBwGCiqGSIb3DQEMAQMwDgQIuhSbsNHd8AACAggABIGQTPXBgmJ0eF8rhNZP
+byXVmsdqNfVXWbAnrZ7r9449XASC41Uxu/Oh1zvcNFf8sH23JmC3B6XbEkjYCVLk
+7Y6rHfoNyEr5TTgWhwAWXnTCd37yeAHdeZoZn1Novr0MphnoBhGpKf4e2+c34uyr
+yTwJ23G7AoYRGLArxidDXmHZd0lS8sNKiTB24kTbuCRf9nxeMSUwIwYJKoZIhvcN
+AQkVMRYEFMZsRTp9P/CQoSF2GMlqvLD1bxihMDEwITAJBgUrDgMCGgUABBROIOH9
+t+89aCCAHtnd6YVL+8+WzwQIEMSRKefwKWUCAggA
+`
+
+func TestSealedPkcs12Source(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	keystore, err := base64.StdEncoding.DecodeString(
+		strings.Replace(keystoreP12, "\n", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAndEncrypt(th, "keystore.p12", string(keystore))
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+files:
+- keystore.p12
+sources:
+- path: keystore.p12
+  binary: true
+  checksum: ` + sha256Hex(keystore) + `
+`)
+
+	decrypted := secretData(t, rm, "keystore.p12")
+	if _, _, err := pkcs12.Decode(decrypted, "changeit"); err != nil {
+		t.Fatalf("decrypted keystore is corrupted: %v", err)
+	}
+}
+
+func TestSealedRandomBytesSource(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	content := make([]byte, 4096)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	// Whitespace before a new line is what kustomize trims from files.
+	content = append(content, " \t\r\n\x00\n"...)
+	writeAndEncrypt(th, "random.bin", string(content))
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+files:
+- random.bin
+sources:
+- path: random.bin
+  binary: true
+  checksum: ` + sha256Hex(content) + `
+`)
+
+	if decrypted := secretData(t, rm, "random.bin"); !bytes.Equal(decrypted, content) {
+		t.Fatalf("decrypted content differs from the original")
+	}
+}
+
+func TestSealedChecksumMismatch(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "/app/longsecret", `iloveyou`)
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+files:
+- longsecret
+sources:
+- path: longsecret
+  checksum: `+sha256Hex([]byte("iloveyou too"))+`
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), `"longsecret" decrypts to sha256 `+sha256Hex([]byte("iloveyou"))) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSealedChecksumUnsealed(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	th.WriteF("/app/longsecret", `iloveyou`)
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+files:
+- longsecret
+sources:
+- path: longsecret
+  checksum: `+sha256Hex([]byte("iloveyou too"))+`
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "sources[0]: sha256 and checksum are only verified by the sealed types") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// secretData returns the decoded value of key in the single Secret of rm.
+func secretData(t *testing.T, rm resmap.ResMap, key string) []byte {
+	data, err := rm.Resources()[0].GetStringMap("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := base64.StdEncoding.DecodeString(data[key])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestSealedTlsChain(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	notAfter := time.Now().AddDate(1, 0, 0)
+	rootCert, rootKey := makeCertificate(t, "root", nil, nil, notAfter)
+	caCert, caKey := makeCertificate(t, "intermediate", rootCert, rootKey, notAfter)
+	cert, key := makeCertificate(t, "example.com", caCert, caKey, notAfter)
+
+	writeAndEncrypt(th, "tls.crt", string(encodeCertificate(cert)))
+	writeAndEncrypt(th, "tls.key", string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})))
+	writeAndEncrypt(th, "ca/intermediate.crt", string(encodeCertificate(caCert)))
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed/tls
+vars:
+  CA: ca
+files:
+- tls.crt
+- tls.key
+tls:
+  intermediates:
+  - ${CA}/intermediate.crt
+  keyFormat: pkcs8
+`)
+
+	chain := string(secretData(t, rm, "tls.crt"))
+	expected := string(encodeCertificate(cert)) + string(encodeCertificate(caCert))
+	if strings.TrimSpace(chain) != strings.TrimSpace(expected) {
+		t.Fatalf("unexpected chain:\n%s", chain)
+	}
+	block, _ := pem.Decode(secretData(t, rm, "tls.key"))
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("tls.key was not converted to pkcs8")
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealedTlsKeyMismatch(t *testing.T) {
+	notAfter := time.Now().AddDate(1, 0, 0)
+	cert, _ := makeCertificate(t, "example.com", nil, nil, notAfter)
+	_, otherKey := makeCertificate(t, "example.org", nil, nil, notAfter)
+
+	err := runTLSGenerator(t, cert, otherKey, "")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "private key does not match public key") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSealedTlsExpired(t *testing.T) {
+	cert, key := makeCertificate(t, "example.com", nil, nil, time.Now().AddDate(0, 0, -1))
+
+	err := runTLSGenerator(t, cert, key, "")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), `certificate "example.com" expired at`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSealedTlsWrongIssuer(t *testing.T) {
+	notAfter := time.Now().AddDate(1, 0, 0)
+	caCert, caKey := makeCertificate(t, "intermediate", nil, nil, notAfter)
+	otherCert, _ := makeCertificate(t, "other", nil, nil, notAfter)
+	cert, key := makeCertificate(t, "example.com", caCert, caKey, notAfter)
+
+	err := runTLSGenerator(t, cert, key, string(encodeCertificate(otherCert)))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), `certificate "example.com" is not issued by "other"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// runTLSGenerator runs a sealed/tls generator on cert and key, along with
+// an intermediate certificate if any, and returns the build error.
+func runTLSGenerator(t *testing.T, cert *x509.Certificate, key *rsa.PrivateKey, intermediate string) error {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "/app/tls.crt", string(encodeCertificate(cert)))
+	writeAndEncrypt(th, "/app/tls.key", string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})))
+	intermediates := ""
+	if intermediate != "" {
+		writeAndEncrypt(th, "/app/intermediate.crt", intermediate)
+		intermediates = "tls:\n  intermediates:\n  - intermediate.crt\n"
+	}
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed/tls
+files:
+- tls.crt
+- tls.key
+`+intermediates)
+
+	return th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+}
+
+// makeCertificate returns a certificate for cn and its key, signed by
+// parent, or self-signed when parent is nil.
+func makeCertificate(t *testing.T, cn string, parent *x509.Certificate, parentKey *rsa.PrivateKey,
+	notAfter time.Time) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notAfter.AddDate(-2, 0, 0),
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func encodeCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func TestSealedDockerConfigJson(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "registries.enc.yaml", `
+registries:
+- registry: ghcr.io
+  username: bot
+  password: s3cr3t
+- registry: registry.example.com
+  username: deploy
+  password: iloveyou
+  email: deploy@example.com
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: pull-secret
+type: Sealed/dockerconfigjson
+registries:
+- registries.enc.yaml
+`)
+
+	if rm.Resources()[0].Map()["type"] != "kubernetes.io/dockerconfigjson" {
+		t.Fatalf("unexpected type %v", rm.Resources()[0].Map()["type"])
+	}
+	expected := `{"auths":{` +
+		`"ghcr.io":{"username":"bot","password":"s3cr3t","auth":"Ym90OnMzY3IzdA=="},` +
+		`"registry.example.com":{"username":"deploy","password":"iloveyou",` +
+		`"email":"deploy@example.com","auth":"ZGVwbG95Omlsb3ZleW91"}}}`
+	if config := string(secretData(t, rm, ".dockerconfigjson")); config != expected {
+		t.Fatalf("unexpected .dockerconfigjson %s", config)
+	}
+}
+
+func TestSealedDockerConfigJsonMissingPassword(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "/app/registries.enc.json", `{
+  "registries": [{"registry": "ghcr.io", "username": "bot"}]
+}`)
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: pull-secret
+type: Sealed/dockerconfigjson
+registries:
+- registries.enc.json
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(),
+		`registry source "registries.enc.json": registries[0] has no password`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSealedKeystores(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	notAfter := time.Now().AddDate(1, 0, 0)
+	caCert, caKey := makeCertificate(t, "ca", nil, nil, notAfter)
+	cert, key := makeCertificate(t, "example.com", caCert, caKey, notAfter)
+	writeAndEncrypt(th, "tls.crt", string(encodeCertificate(cert)))
+	writeAndEncrypt(th, "tls.key", string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})))
+	writeAndEncrypt(th, "ca.crt", string(encodeCertificate(caCert)))
+	writeAndEncrypt(th, "password", "changeit\n")
+
+	config := `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+keystores:
+- key: keystore.p12
+  privateKey: tls.key
+  certificates:
+  - tls.crt
+  password: password
+- key: keystore.jks
+  alias: Server
+  privateKey: tls.key
+  certificates:
+  - tls.crt
+  - ca.crt
+  password: password
+- key: truststore.jks
+  alias: ca
+  certificates:
+  - ca.crt
+  password: password
+`
+	rm := th.LoadAndRunGenerator(config)
+
+	privateKey, certificate, err := pkcs12.Decode(secretData(t, rm, "keystore.p12"), "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, ok := privateKey.(*rsa.PrivateKey)
+	if !ok || rsaKey.N.Cmp(key.N) != 0 || !certificate.Equal(cert) {
+		t.Fatalf("keystore.p12 does not hold the key and certificate")
+	}
+
+	keytoolList(t, secretData(t, rm, "keystore.jks"), "changeit", "server")
+	keytoolList(t, secretData(t, rm, "truststore.jks"), "changeit", "ca")
+
+	entries := readJKS(t, secretData(t, rm, "keystore.jks"), "changeit")
+	if len(entries) != 1 || entries[0].alias != "server" {
+		t.Fatalf("unexpected keystore.jks entries %v", entries)
+	}
+	expectedKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(entries[0].key, expectedKey) {
+		t.Fatalf("keystore.jks does not hold the key")
+	}
+	if len(entries[0].certs) != 2 ||
+		!bytes.Equal(entries[0].certs[0], cert.Raw) || !bytes.Equal(entries[0].certs[1], caCert.Raw) {
+		t.Fatalf("keystore.jks does not hold the certificate chain")
+	}
+
+	entries = readJKS(t, secretData(t, rm, "truststore.jks"), "changeit")
+	if len(entries) != 1 || entries[0].key != nil || !bytes.Equal(entries[0].certs[0], caCert.Raw) {
+		t.Fatalf("unexpected truststore.jks entries %v", entries)
+	}
+
+	again := th.LoadAndRunGenerator(config)
+	if !bytes.Equal(secretData(t, again, "keystore.p12"), secretData(t, rm, "keystore.p12")) ||
+		!bytes.Equal(secretData(t, again, "keystore.jks"), secretData(t, rm, "keystore.jks")) {
+		t.Fatalf("keystores are not deterministic")
+	}
+}
+
+// keytoolList checks that keytool, an independent reader, opens the JKS
+// keystore and finds the alias in it. It is skipped without keytool.
+func keytoolList(t *testing.T, keystore []byte, password, alias string) {
+	t.Helper()
+	keytool, err := exec.LookPath("keytool")
+	if err != nil {
+		t.Log("keytool not found, skipping the independent JKS check")
+		return
+	}
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keystore.jks")
+	if err := ioutil.WriteFile(path, keystore, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(keytool, "-list", "-keystore", path,
+		"-storetype", "JKS", "-storepass", password).CombinedOutput()
+	if err != nil {
+		t.Fatalf("keytool -list: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), alias+",") {
+		t.Fatalf("keytool -list does not show %q:\n%s", alias, out)
+	}
+}
+
+type jksEntry struct {
+	alias string
+	key   []byte
+	certs [][]byte
+}
+
+// readJKS reads the entries of a JKS keystore, checking its integrity and
+// recovering the private keys.
+func readJKS(t *testing.T, data []byte, password string) []jksEntry {
+	var passwd []byte
+	for _, r := range password {
+		passwd = append(passwd, byte(r>>8), byte(r))
+	}
+	body, digest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	h := sha1.New()
+	h.Write(passwd)
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(body)
+	if !bytes.Equal(h.Sum(nil), digest) {
+		t.Fatalf("keystore integrity check failed")
+	}
+
+	r := bytes.NewReader(body)
+	read := func(v interface{}) {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readBytes := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	readUTF := func() string {
+		var n uint16
+		read(&n)
+		return string(readBytes(int(n)))
+	}
+	readCert := func() []byte {
+		if certType := readUTF(); certType != "X.509" {
+			t.Fatalf("unexpected certificate type %q", certType)
+		}
+		var n uint32
+		read(&n)
+		return readBytes(int(n))
+	}
+
+	var magic, version, count uint32
+	read(&magic)
+	read(&version)
+	read(&count)
+	if magic != 0xFEEDFEED || version != 2 {
+		t.Fatalf("not a JKS keystore")
+	}
+	var entries []jksEntry
+	for i := uint32(0); i < count; i++ {
+		var tag uint32
+		var timestamp int64
+		read(&tag)
+		entry := jksEntry{alias: readUTF()}
+		read(&timestamp)
+		if tag == 2 {
+			entry.certs = append(entry.certs, readCert())
+			entries = append(entries, entry)
+			continue
+		}
+
+		var n uint32
+		read(&n)
+		var info struct {
+			Algorithm     pkix.AlgorithmIdentifier
+			EncryptedData []byte
+		}
+		if _, err := asn1.Unmarshal(readBytes(int(n)), &info); err != nil {
+			t.Fatal(err)
+		}
+		protected := info.EncryptedData
+		salt := protected[:20]
+		encrypted := protected[20 : len(protected)-sha1.Size]
+		digest := salt
+		for j := range encrypted {
+			if j%sha1.Size == 0 {
+				sum := sha1.Sum(append(append([]byte{}, passwd...), digest...))
+				digest = sum[:]
+			}
+			entry.key = append(entry.key, encrypted[j]^digest[j%sha1.Size])
+		}
+		check := sha1.Sum(append(append([]byte{}, passwd...), entry.key...))
+		if !bytes.Equal(check[:], protected[len(protected)-sha1.Size:]) {
+			t.Fatalf("unable to recover the key of %q", entry.alias)
+		}
+
+		read(&n)
+		for j := uint32(0); j < n; j++ {
+			entry.certs = append(entry.certs, readCert())
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestSealedSSHAuth(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAndEncrypt(th, "id_rsa", string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})))
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPublicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewPublicKey(hostPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAndEncrypt(th, "host_key.pub", string(ssh.MarshalAuthorizedKey(hostKey)))
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed/ssh-auth
+files:
+- ssh-privatekey=id_rsa
+ssh:
+  publicKey: true
+  knownHosts:
+  - hosts:
+    - git.example.com
+    - git.example.com:2222
+    key: host_key.pub
+`)
+
+	if got := string(secretData(t, rm, "ssh-publickey")); got != string(ssh.MarshalAuthorizedKey(publicKey)) {
+		t.Fatalf("unexpected ssh-publickey %q", got)
+	}
+	expected := "git.example.com,[git.example.com]:2222 " + string(ssh.MarshalAuthorizedKey(hostKey))
+	if got := string(secretData(t, rm, "known_hosts")); got != expected {
+		t.Fatalf("unexpected known_hosts %q", got)
+	}
+}
+
+func TestSealedSSHAuthPassphrase(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY",
+		x509.MarshalPKCS1PrivateKey(key), []byte("s3cr3t"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAndEncrypt(th, "/app/id_rsa", string(pem.EncodeToMemory(block)))
+	writeAndEncrypt(th, "/app/passphrase", "s3cr3t\n")
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	generator := `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed/ssh-auth
+files:
+- ssh-privatekey=id_rsa
+`
+	th.WriteF("/app/generator.yaml", generator)
+
+	err = th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "the key is protected by a passphrase, set ssh.passphrase") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	th.WriteF("/app/generator.yaml", generator+`
+ssh:
+  passphrase: passphrase
+  publicKey: true
+`)
+	rm := th.Run("/app", th.MakeOptionsPluginsEnabled())
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(secretData(t, rm, "ssh-publickey")); got != string(ssh.MarshalAuthorizedKey(publicKey)) {
+		t.Fatalf("unexpected ssh-publickey %q", got)
+	}
+}
+
+func TestSealedSSHAuthOpenSSHPassphrase(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	// The format ssh-keygen writes by default.
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("s3cr3t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAndEncrypt(th, "/app/id_ed25519", string(pem.EncodeToMemory(block)))
+	writeAndEncrypt(th, "/app/passphrase", "s3cr3t\n")
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed/ssh-auth
+files:
+- ssh-privatekey=id_ed25519
+ssh:
+  passphrase: passphrase
+  publicKey: true
+`)
+
+	rm := th.Run("/app", th.MakeOptionsPluginsEnabled())
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(secretData(t, rm, "ssh-publickey")); got != string(ssh.MarshalAuthorizedKey(sshPublicKey)) {
+		t.Fatalf("unexpected ssh-publickey %q", got)
+	}
+}
+
+func TestSealedStructuredEnvs(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "app.enc.yaml", `
+DB_USER: admin
+DB_PORT: 5432
+DEBUG: false
+`)
+	writeAndEncrypt(th, "api.enc.json", `{
+  "prod": {"API_TOKEN": "s3cr3t"},
+  "dev": {"API_TOKEN": "dev"}
+}`)
+	writeAndEncrypt(th, "app.enc.ini", `
+ROUTER_PASSWORD = admin
+
+[cache]
+CACHE_PASSWORD = iloveyou
+`)
+	writeAndEncrypt(th, "cache.enc.ini", `
+[cache]
+CACHE_PASSWORD = iloveyou
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+envs:
+- app.enc.yaml
+- api.enc.json
+- app.enc.ini
+- cache.enc.ini
+sources:
+- path: api.enc.json
+  section: prod
+- path: cache.enc.ini
+  section: cache
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  API_TOKEN: czNjcjN0
+  CACHE_PASSWORD: aWxvdmV5b3U=
+  DB_PORT: NTQzMg==
+  DB_USER: YWRtaW4=
+  DEBUG: ZmFsc2U=
+  ROUTER_PASSWORD: YWRtaW4=
+kind: Secret
+metadata:
+  name: mySecret
+type: Opaque
+`)
+}
+
+func TestSealedFlattenEnvs(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "values.enc.yaml", `
+DB:
+  HOST: db.example.com
+  CREDENTIALS:
+    PASSWORD: s3cr3t
+HOSTS:
+- a.example.com
+- b.example.com
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+envs:
+- values.enc.yaml
+flatten:
+  maps: join
+  arrays: index
+  separator: __
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  DB__CREDENTIALS__PASSWORD: czNjcjN0
+  DB__HOST: ZGIuZXhhbXBsZS5jb20=
+  HOSTS__0: YS5leGFtcGxlLmNvbQ==
+  HOSTS__1: Yi5leGFtcGxlLmNvbQ==
+kind: Secret
+metadata:
+  name: mySecret
+type: Opaque
+`)
+
+	rm = th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+envs:
+- values.enc.yaml
+flatten:
+  maps: json
+  arrays: json
+`)
+
+	if got := string(secretData(t, rm, "DB")); got !=
+		`{"CREDENTIALS":{"PASSWORD":"s3cr3t"},"HOST":"db.example.com"}` {
+		t.Fatalf("unexpected DB %s", got)
+	}
+	if got := string(secretData(t, rm, "HOSTS")); got != `["a.example.com","b.example.com"]` {
+		t.Fatalf("unexpected HOSTS %s", got)
+	}
+}
+
+func TestSealedFlattenNumericKeys(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	// SOPS parses these keys as integers.
+	th.WriteF("values.yaml", `
+8080: http
+PORTS:
+  443: https
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+envs:
+- values.yaml
+flatten:
+  maps: join
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  "8080": aHR0cA==
+  PORTS.443: aHR0cHM=
+kind: Secret
+metadata:
+  name: mySecret
+type: Opaque
+`)
+
+	rm = th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+envs:
+- values.yaml
+flatten:
+  maps: json
+`)
+
+	if got := string(secretData(t, rm, "PORTS")); got != `{"443":"https"}` {
+		t.Fatalf("unexpected PORTS %s", got)
+	}
+}
+
+func TestSealedNestedEnvWithoutFlatten(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "/app/values.enc.yaml", `
+db:
+  host: db.example.com
+`)
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+envs:
+- values.enc.yaml
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(),
+		`env source "values.enc.yaml": key "db" holds a map, set flatten.maps to join or json`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSealedSanitizedKeys(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "a.env", `
+db/password=s3cr3t
+db user=admin
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+envs:
+- a.env
+keys:
+  sanitize: true
+  mapping:
+    /: .
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  db.password: czNjcjN0
+  db_user: YWRtaW4=
+kind: Secret
+metadata:
+  name: mySecret
+type: Opaque
+`)
+}
+
+func TestSealedInvalidKey(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	writeAndEncrypt(th, "/app/a.env", `
+db/password=s3cr3t
+`)
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+envs:
+- a.env
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), `key "db/password" from "a.env" is not a valid Secret key`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSealedSizeLimit(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	// Kubernetes limits the decoded values, not the base64 encoded Secret.
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+size:
+  limit: 1000
+literals:
+- large=` + strings.Repeat("b", 1000) + `
+`)
+	if got := len(secretData(t, rm, "large")); got != 1000 {
+		t.Fatalf("unexpected large of %d bytes", got)
+	}
+
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+size:
+  limit: 1000
+literals:
+- small=`+strings.Repeat("a", 30)+`
+- large=`+strings.Repeat("b", 971)+`
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "is 1001 bytes, over the limit of 1000 bytes") ||
+		!strings.Contains(err.Error(), "  large: 971 bytes\n  small: 30 bytes") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSealedSizeSplit(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+disableNameSuffixHash: true
+size:
+  limit: 1000
+  split: true
+literals:
+- a=`+strings.Repeat("a", 500)+`
+- b=`+strings.Repeat("b", 500)+`
+- c=`+strings.Repeat("c", 30)+`
+`)
+
+	rm := th.Run("/app", th.MakeOptionsPluginsEnabled())
+	var names []string
+	for _, res := range rm.Resources() {
+		names = append(names, res.GetName())
+		data, err := res.GetStringMap("data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := 0
+		for _, value := range data {
+			size += base64.StdEncoding.DecodedLen(len(value))
+		}
+		if size > 1000 {
+			t.Errorf("%s is %d bytes", res.GetName(), size)
+		}
+	}
+	if fmt.Sprint(names) != "[mySecret-0 mySecret-1]" {
+		t.Fatalf("unexpected Secrets %v", names)
+	}
+	expected := `[{"name":"mySecret-0","keys":["a"]},` +
+		`{"name":"mySecret-1","keys":["b","c"]}]`
+	if manifest := string(secretData(t, rm, "manifest.json")); manifest != expected {
+		t.Fatalf("unexpected manifest %s", manifest)
+	}
+}
+
+func TestSealedSizeSplitWithHash(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+size:
+  split: true
+literals:
+- a=admin
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "size.split needs disableNameSuffixHash") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSealedCompression(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	geoip := strings.Repeat("GeoIP2-City.", 200)
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+compression:
+  codec: gzip
+  keys:
+  - "*.mmdb"
+  - config.json
+  minSize: 64
+literals:
+- city.mmdb=` + geoip + `
+- config.json={}
+- user=` + strings.Repeat("admin", 20) + `
+`)
+
+	annotations := rm.Resources()[0].GetAnnotations()
+	if annotations["sealed.secrets/compression"] != `{"city.mmdb":"gzip"}` {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(secretData(t, rm, "city.mmdb")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decompressed) != geoip {
+		t.Fatalf("unexpected city.mmdb %q", decompressed)
+	}
+	if value := string(secretData(t, rm, "config.json")); value != "{}" {
+		t.Fatalf("unexpected config.json %q", value)
+	}
+	if value := string(secretData(t, rm, "user")); value != strings.Repeat("admin", 20) {
+		t.Fatalf("unexpected user %q", value)
+	}
+}
+
+func TestSealedCompressionZstd(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	geoip := strings.Repeat("GeoIP2-City.", 200)
+	rm := th.LoadAndRunGenerator(`
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+compression:
+  codec: zstd
+  keys:
+  - "*.mmdb"
+literals:
+- city.mmdb=` + geoip + `
+- user=` + strings.Repeat("admin", 20) + `
+`)
+
+	annotations := rm.Resources()[0].GetAnnotations()
+	if annotations["sealed.secrets/compression"] != `{"city.mmdb":"zstd"}` {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+	compressed := secretData(t, rm, "city.mmdb")
+	r, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	decompressed, err := r.DecodeAll(compressed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decompressed) != geoip {
+		t.Fatalf("unexpected city.mmdb %q", decompressed)
+	}
+	if value := string(secretData(t, rm, "user")); value != strings.Repeat("admin", 20) {
+		t.Fatalf("unexpected user %q", value)
+	}
+
+	// The zstd command line tool, when installed, must read it as well.
+	if zstdPath, err := exec.LookPath("zstd"); err == nil {
+		cmd := exec.Command(zstdPath, "-d", "-c")
+		cmd.Stdin = bytes.NewReader(compressed)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("zstd -d: %v", err)
+		}
+		if string(out) != geoip {
+			t.Fatalf("zstd -d returned %q", out)
+		}
+	}
+}
+
+func TestSealedCompressionUnknownCodec(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(
+		"sealed.secrets", "v1", "SealedSecretGenerator")
+	defer th.Reset()
+
+	th.WriteK("/app", `
+generators:
+- generator.yaml
+`)
+	th.WriteF("/app/generator.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: mySecret
+type: Sealed
+compression:
+  codec: lz4
+literals:
+- user=admin
+`)
+
+	err := th.RunWithErr("/app", th.MakeOptionsPluginsEnabled())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), `unknown compression codec "lz4", expected gzip or zstd`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// goldenSources are encrypted anew before each build of TestSealedGolden,
+// so that the output cannot depend on the ciphertext.
+var goldenSources = map[string]string{
+	"/app/config.enc.yaml": `
+# The server settings
+server:
+  port: 8080
+  host: example.com
+  tls: {key: server.key, cert: server.crt}
+users:
+- name: admin
+  roles: [read, write]
+- name: guest
+  roles: [read]
+motd: |
+  Welcome
+  to the server
+`,
+	"/app/account.enc.json": `{
+  "type": "service_account",
+  "scopes": ["<read>", "<write>"],
+  "client": {"id": 42, "email": "a&b@example.com", "enabled": true, "expires": null}
+}`,
+	"/app/app.enc.yaml": `
+db:
+  user: admin
+  host: db.example.com
+debug: false
+`,
+	"/app/a.env": `
+ROUTER_PASSWORD=admin
+`,
+}
+
+func TestSealedGolden(t *testing.T) {
+	th := sealedtest.NewHarness(t)
+	defer th.Reset()
+
+	th.WriteK("/app", `
+generators:
+- files.yaml
+- compressed.yaml
+`)
+	th.WriteF("/app/files.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: files
+type: Sealed
+immutable: true
+files:
+- config.enc.yaml
+- account.enc.json
+envs:
+- app.enc.yaml
+- a.env
+literals:
+- user=admin
+flatten:
+  maps: join
+`)
+	th.WriteF("/app/compressed.yaml", `
+apiVersion: sealed.secrets/v1
+kind: SealedSecretGenerator
+metadata:
+  name: compressed
+type: Sealed
+files:
+- config.yaml=config.enc.yaml
+compression:
+  codec: gzip
+`)
+
+	var builds [][]byte
+	for i := 0; i < 2; i++ {
+		for path, content := range goldenSources {
+			th.WriteEncrypted(path, content)
+		}
+		builds = append(builds, th.Build("/app"))
+	}
+	if !bytes.Equal(builds[0], builds[1]) {
+		t.Fatalf("builds differ:\n%s\n---\n%s", builds[0], builds[1])
+	}
+	sealedtest.AssertGolden(t, builds[0], filepath.Join("testdata", t.Name()+".golden.yaml"))
+}
+
+// tamper edits an encrypted dotenv file the way a careless editor would,
+// leaving the values intact but invalidating its MAC.
+func tamper(th *kusttest_test.HarnessEnhanced, path string) {
+	content, err := th.GetFSys().ReadFile(path)
+	if err != nil {
+		th.GetT().Fatal(err)
+	}
+	th.WriteF(path, regexp.MustCompile(`sops_lastmodified=.*`).
+		ReplaceAllString(string(content), "sops_lastmodified=2000-01-01T00:00:00Z"))
+}
+
+// fileWriter is implemented by both the plain and the enhanced harness.
+type fileWriter interface {
+	GetT() *testing.T
+	WriteF(path string, content string)
+}
+
+func writeAndEncrypt(th fileWriter, path, content string) {
+	encryptedContent, err := encrypt(path, content)
+	if err != nil {
+		th.GetT().Fatal(err)
+		return
+	}
+	th.WriteF(path, string(encryptedContent))
+}
+
+// encrypt encrypts content for the key generated by TestMain.
+func encrypt(path, content string) ([]byte, error) {
+	return sealedtest.Encrypt(path, []byte(content), testKey)
 }
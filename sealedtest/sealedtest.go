@@ -0,0 +1,265 @@
+// Package sealedtest helps unit testing kustomizations that use the
+// SealedSecretGenerator plugin. It generates throwaway PGP keys, writes
+// fixtures encrypted with SOPS for them, runs kustomize builds through the
+// kusttest harness and compares their output with golden files.
+//
+// The keys live in a temporary GnuPG home, which GNUPGHOME points to while
+// the keyring is open, so tests using them cannot run in parallel. Only PGP
+// keys are supported, age requires SOPS 3.7 or later.
+//
+// The kusttest harness compiles the plugin from SealedSecretGenerator.go,
+// which must be in the directory of the test or under the kustomize plugin
+// source root, as sealed.secrets/v1/sealedsecretgenerator/SealedSecretGenerator.go.
+package sealedtest
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/aes"
+	"go.mozilla.org/sops/v3/cmd/sops/common"
+	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	"go.mozilla.org/sops/v3/keyservice"
+	"go.mozilla.org/sops/v3/pgp"
+	"go.mozilla.org/sops/v3/version"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	kusttest_test "sigs.k8s.io/kustomize/api/testutils/kusttest"
+)
+
+const (
+	// Group, Version and Kind identify the plugin in the kusttest harness.
+	Group   = "sealed.secrets"
+	Version = "v1"
+	Kind    = "SealedSecretGenerator"
+
+	// UpdateEnv names the environment variable which, when set to a non
+	// empty value, makes AssertGolden write the golden files instead of
+	// comparing them.
+	UpdateEnv = "SEALEDTEST_UPDATE"
+)
+
+// Keyring is a temporary GnuPG home holding throwaway PGP keys.
+type Keyring struct {
+	// Home is the directory GNUPGHOME points to while the keyring is open.
+	Home string
+
+	entities   openpgp.EntityList
+	oldHome    string
+	wasSet     bool
+	restoreEnv bool
+}
+
+// PGPKey is a throwaway PGP key of a Keyring.
+type PGPKey struct {
+	// Fingerprint is the upper case hexadecimal fingerprint SOPS refers to
+	// the key with.
+	Fingerprint string
+}
+
+// NewKeyring creates an empty keyring in a temporary directory, and points
+// GNUPGHOME to it until Close is called.
+func NewKeyring() (*Keyring, error) {
+	home, err := ioutil.TempDir("", "sealedtest-gnupg")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(home, 0700); err != nil {
+		os.RemoveAll(home)
+		return nil, err
+	}
+	k := &Keyring{Home: home, restoreEnv: true}
+	k.oldHome, k.wasSet = os.LookupEnv("GNUPGHOME")
+	os.Setenv("GNUPGHOME", home)
+	return k, nil
+}
+
+// Generate adds a new PGP key to the keyring.
+func (k *Keyring) Generate(name string) (*PGPKey, error) {
+	// Without preferences, openpgp falls back to RIPEMD160, which it does
+	// not compile in, and fails to encrypt.
+	config := &packet.Config{
+		DefaultHash:   crypto.SHA256,
+		DefaultCipher: packet.CipherAES256,
+	}
+	entity, err := openpgp.NewEntity(name, "sealedtest", "", config)
+	if err != nil {
+		return nil, err
+	}
+	// NewEntity records the preferences after signing the identity.
+	for _, id := range entity.Identities {
+		if err := id.SelfSignature.SignUserId(id.UserId.Id, entity.PrimaryKey, entity.PrivateKey, config); err != nil {
+			return nil, err
+		}
+	}
+	k.entities = append(k.entities, entity)
+	if err := k.write(); err != nil {
+		return nil, err
+	}
+	return &PGPKey{
+		Fingerprint: strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint[:])),
+	}, nil
+}
+
+// write saves the keys in the pubring.gpg and secring.gpg files SOPS reads.
+func (k *Keyring) write() error {
+	var pub, sec bytes.Buffer
+	for _, entity := range k.entities {
+		if err := entity.Serialize(&pub); err != nil {
+			return err
+		}
+		if err := entity.SerializePrivate(&sec, nil); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(k.Home, "pubring.gpg"), pub.Bytes(), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(k.Home, "secring.gpg"), sec.Bytes(), 0600)
+}
+
+// Close restores GNUPGHOME and removes the keyring.
+func (k *Keyring) Close() error {
+	if k.restoreEnv {
+		if k.wasSet {
+			os.Setenv("GNUPGHOME", k.oldHome)
+		} else {
+			os.Unsetenv("GNUPGHOME")
+		}
+		k.restoreEnv = false
+	}
+	return os.RemoveAll(k.Home)
+}
+
+// Encrypt encrypts content with SOPS, in the format of path, so that any of
+// keys can decrypt it.
+func Encrypt(path string, content []byte, keys ...*PGPKey) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%q: no key to encrypt for", path)
+	}
+	store := common.StoreForFormat(formats.FormatForPath(path))
+	branches, err := store.LoadPlainFile(content)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", path, err)
+	}
+
+	var group sops.KeyGroup
+	for _, key := range keys {
+		group = append(group, pgp.NewMasterKeyFromFingerprint(key.Fingerprint))
+	}
+	tree := sops.Tree{
+		Branches: branches,
+		Metadata: sops.Metadata{
+			KeyGroups: []sops.KeyGroup{group},
+			Version:   version.Version,
+		},
+		FilePath: path,
+	}
+	dataKey, errs := tree.GenerateDataKeyWithKeyServices(
+		[]keyservice.KeyServiceClient{keyservice.NewLocalClient()})
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%q: could not generate data key: %v", path, errs)
+	}
+	err = common.EncryptTree(common.EncryptTreeOpts{
+		DataKey: dataKey,
+		Tree:    &tree,
+		Cipher:  aes.NewCipher(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", path, err)
+	}
+	return store.EmitEncryptedFile(tree)
+}
+
+// AssertGolden compares actual with the content of the golden file, or
+// writes it there when UpdateEnv is set.
+func AssertGolden(t testing.TB, actual []byte, golden string) {
+	t.Helper()
+	if os.Getenv(UpdateEnv) != "" {
+		if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(golden, actual, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%v, set %s=1 to create it", err, UpdateEnv)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("output differs from %s, set %s=1 to update it:\n%s", golden, UpdateEnv, actual)
+	}
+}
+
+// Harness builds kustomizations with the plugin, decrypting the fixtures
+// written with WriteEncrypted with a throwaway key.
+type Harness struct {
+	*kusttest_test.HarnessEnhanced
+
+	Keyring *Keyring
+	Key     *PGPKey
+}
+
+// NewHarness compiles the plugin and generates the key of a new Harness.
+// Reset must be called once the test is done.
+func NewHarness(t *testing.T) *Harness {
+	th := &Harness{
+		HarnessEnhanced: kusttest_test.MakeEnhancedHarness(t).BuildGoPlugin(Group, Version, Kind),
+	}
+	var err error
+	if th.Keyring, err = NewKeyring(); err != nil {
+		th.HarnessEnhanced.Reset()
+		t.Fatal(err)
+	}
+	if th.Key, err = th.Keyring.Generate(t.Name()); err != nil {
+		th.Reset()
+		t.Fatal(err)
+	}
+	return th
+}
+
+// WriteEncrypted writes content to path, encrypted for the key of the harness.
+func (th *Harness) WriteEncrypted(path, content string) {
+	encrypted, err := Encrypt(path, []byte(content), th.Key)
+	if err != nil {
+		th.GetT().Fatal(err)
+	}
+	th.WriteF(path, string(encrypted))
+}
+
+// Build runs the kustomization at path, with plugins enabled, and returns
+// its output as YAML.
+func (th *Harness) Build(path string) []byte {
+	rm := th.Run(path, th.MakeOptionsPluginsEnabled())
+	out, err := rm.AsYaml()
+	if err != nil {
+		th.GetT().Fatal(err)
+	}
+	return out
+}
+
+// AssertGolden builds the kustomization at path and compares its output
+// with the golden file.
+func (th *Harness) AssertGolden(path, golden string) {
+	AssertGolden(th.GetT(), th.Build(path), golden)
+}
+
+// Reset removes the keyring and the compiled plugin.
+func (th *Harness) Reset() {
+	if th.Keyring != nil {
+		if err := th.Keyring.Close(); err != nil {
+			th.GetT().Error(err)
+		}
+	}
+	th.HarnessEnhanced.Reset()
+}
@@ -0,0 +1,86 @@
+package sealedtest_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	"go.mozilla.org/sops/v3/decrypt"
+
+	"github.com/jbrixhe/kustomize-sealed-secrets/sealedtest"
+)
+
+func TestEncrypt(t *testing.T) {
+	keyring, err := sealedtest.NewKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyring.Close()
+	if os.Getenv("GNUPGHOME") != keyring.Home {
+		t.Fatalf("GNUPGHOME is %q, expected %q", os.Getenv("GNUPGHOME"), keyring.Home)
+	}
+
+	alice, err := keyring.Generate("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := keyring.Generate("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alice.Fingerprint) != 40 || alice.Fingerprint == bob.Fingerprint {
+		t.Fatalf("unexpected fingerprints %q and %q", alice.Fingerprint, bob.Fingerprint)
+	}
+
+	encrypted, err := sealedtest.Encrypt("secret.env", []byte("PASSWORD=admin\n"), alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := decrypt.DataWithFormat(encrypted, formats.Dotenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "PASSWORD=admin\n" {
+		t.Fatalf("unexpected plain text %q", plain)
+	}
+
+	if _, err := sealedtest.Encrypt("secret.env", []byte("PASSWORD=admin\n")); err == nil {
+		t.Fatal("expected an error without keys")
+	}
+}
+
+func TestKeyringClose(t *testing.T) {
+	os.Setenv("GNUPGHOME", "/previous")
+	defer os.Unsetenv("GNUPGHOME")
+
+	keyring, err := sealedtest.NewKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("GNUPGHOME") != "/previous" {
+		t.Fatalf("GNUPGHOME is %q, expected /previous", os.Getenv("GNUPGHOME"))
+	}
+	if _, err := os.Stat(keyring.Home); !os.IsNotExist(err) {
+		t.Fatalf("%s was not removed: %v", keyring.Home, err)
+	}
+}
+
+func TestAssertGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sealedtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	golden := filepath.Join(dir, "testdata", "out.golden.yaml")
+
+	os.Setenv(sealedtest.UpdateEnv, "1")
+	sealedtest.AssertGolden(t, []byte("kind: Secret\n"), golden)
+	os.Unsetenv(sealedtest.UpdateEnv)
+
+	sealedtest.AssertGolden(t, []byte("kind: Secret\n"), golden)
+}